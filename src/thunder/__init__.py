@@ -4,3 +4,34 @@ This module provides integration with Thunder Compute for running workloads on G
 """
 
 from .main import Thunder
+from .errors import (
+    DestroyGuardError,
+    DrainError,
+    EngineProbeError,
+    GroupNotReadyError,
+    InstanceLimitReachedError,
+    InvalidBaseURLError,
+    InvalidResponseError,
+    PollTimeoutError,
+    PostReadyHookError,
+    ThunderAPIError,
+    TokenRequiredError,
+    UnsupportedEndpointError,
+    WaitTimeoutError,
+)
+from .poller import Poller
+from .request_ids import current_request_id, use_request_id
+from .models import (
+    Deployment,
+    DestroyReport,
+    DiagnosticStep,
+    Diagnostics,
+    Instance,
+    InstanceMetrics,
+    InstanceType,
+    Label,
+    MatrixResult,
+    Quota,
+    Region,
+    Volume,
+)
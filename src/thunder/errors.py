@@ -0,0 +1,167 @@
+"""Errors raised by the Thunder module"""
+import json
+from typing import TYPE_CHECKING
+
+from .request_ids import current_request_id
+
+if TYPE_CHECKING:
+    from .models import Instance
+
+
+class TokenRequiredError(ValueError):
+    """Raised when a function that talks to the Thunder API is called without a token"""
+
+    def __init__(self, message: str = "Thunder API token is required"):
+        super().__init__(message)
+
+
+class InvalidBaseURLError(ValueError):
+    """Raised when a Thunder API base URL is empty or malformed"""
+
+    def __init__(self, url: str, reason: str):
+        self.url = url
+        self.reason = reason
+        super().__init__(f"Invalid Thunder API base URL {url!r}: {reason}")
+
+
+class UnsupportedEndpointError(RuntimeError):
+    """Raised when the Thunder API does not expose the endpoint a function relies on"""
+
+    def __init__(self, feature: str, status_code: int):
+        self.feature = feature
+        self.status_code = status_code
+        super().__init__(f"Thunder API does not support {feature} (HTTP {status_code})")
+
+
+class DestroyGuardError(RuntimeError):
+    """Raised when destroying an instance that doesn't carry the configured guard label"""
+
+    def __init__(self, instance_id: str, key: str, value: str):
+        self.instance_id = instance_id
+        self.key = key
+        self.value = value
+        super().__init__(f"Refusing to destroy instance {instance_id}: it is not labelled {key}={value}")
+
+
+class DrainError(RuntimeError):
+    """Raised when the drain command fails and the drain failure policy is abort"""
+
+    def __init__(self, instance_id: str, reason: str):
+        self.instance_id = instance_id
+        self.reason = reason
+        super().__init__(f"Drain of instance {instance_id} failed, not destroying it: {reason}")
+
+
+class EngineProbeError(RuntimeError):
+    """Raised when an instance's engine doesn't pass the configured health probe"""
+
+    def __init__(self, instance_id: str, probe: str, target: str, reason: str):
+        self.instance_id = instance_id
+        self.probe = probe
+        self.target = target
+        self.reason = reason
+        super().__init__(f"{probe} health probe of instance {instance_id} at {target} failed: {reason}")
+
+
+class PollTimeoutError(RuntimeError):
+    """Raised when a Poller's check doesn't report done before the timeout"""
+
+    def __init__(self, timeout: float, attempts: int):
+        self.timeout = timeout
+        self.attempts = attempts
+        super().__init__(f"Still not done after {attempts} attempts in {timeout:g}s")
+
+
+class WaitTimeoutError(RuntimeError):
+    """Raised when an instance doesn't reach a status in time
+
+    The instance is the one being waited for, with the last status seen, so
+    the caller can decide whether to wait longer or destroy it. It is not
+    necessarily usable: a deploy that timed out may have no host yet. When
+    destroyed is set the deploy already destroyed it.
+    """
+
+    def __init__(self, instance: "Instance", reason: str, destroyed: bool = False):
+        self.instance = instance
+        self.reason = reason
+        self.destroyed = destroyed
+        outcome = "destroyed" if destroyed else f"left {instance.status or 'unknown'}"
+        super().__init__(f"{reason}, instance {instance.instance_id} was {outcome}")
+
+
+class GroupNotReadyError(RuntimeError):
+    """Raised when instances carrying a group label aren't all ready in time"""
+
+    def __init__(self, label: str, timeout: int, pending: list[str]):
+        self.label = label
+        self.timeout = timeout
+        self.pending = pending
+        detail = f"still not ready: {', '.join(pending)}" if pending else "no instances carry the label"
+        super().__init__(f"Timed out after {timeout}s waiting for instances labelled {label}, {detail}")
+
+
+class PostReadyHookError(RuntimeError):
+    """Raised when the post-ready hook fails on a freshly deployed instance"""
+
+    def __init__(self, instance_id: str, reason: str):
+        self.instance_id = instance_id
+        self.reason = reason
+        super().__init__(f"Post-ready hook failed on instance {instance_id}: {reason}")
+
+
+class InstanceLimitReachedError(RuntimeError):
+    """Raised when deploying would exceed a client-side limit on active instances"""
+
+    def __init__(self, active: int, limit: int):
+        self.active = active
+        self.limit = limit
+        super().__init__(f"Instance limit reached: {active} active instances, limit is {limit}")
+
+
+class InvalidResponseError(RuntimeError):
+    """Raised when a Thunder API response can't be parsed or lacks a required field"""
+
+    def __init__(self, source: str, reason: str, response: str):
+        self.source = source
+        self.reason = reason
+        self.response = response
+        super().__init__(f"Invalid {source} response: {reason}: {response}")
+
+
+class ThunderAPIError(RuntimeError):
+    """Raised when the Thunder API answers a request with an error status
+
+    When the response body is a JSON error object, at the top level or nested
+    under "error", its code and message are exposed separately, so callers
+    can branch on the code. Otherwise the raw
+    body is used as the message and the code is empty. The ID of the
+    operation the request was made for is recorded to correlate with logs.
+    """
+
+    def __init__(self, operation: str, status_code: int, message: str, code: str = "", body: str = ""):
+        self.operation = operation
+        self.status_code = status_code
+        self.message = message
+        self.code = code
+        self.body = body
+        self.request_id = current_request_id()
+        detail = f"HTTP {status_code}, {code}" if code else f"HTTP {status_code}"
+        if self.request_id:
+            detail += f", request ID {self.request_id}"
+        super().__init__(f"Failed to {operation} ({detail}): {message}")
+
+    @classmethod
+    def from_response(cls, operation: str, status_code: int, body: str) -> "ThunderAPIError":
+        """Build the error from an API response, parsing JSON error bodies when possible"""
+        try:
+            data = json.loads(body)
+        except json.JSONDecodeError:
+            data = None
+        if isinstance(data, dict) and isinstance(data.get('error'), dict):
+            # Some errors nest their details, as {"error": {"message": ..., "code": ...}}
+            data = {'code': data.get('code'), **data['error']}
+        if isinstance(data, dict) and ('error' in data or 'message' in data):
+            message = str(data.get('error') or data.get('message') or "").strip()
+            code = str(data.get('code') or "").strip()
+            return cls(operation, status_code, message or body.strip(), code, body)
+        return cls(operation, status_code, body.strip(), "", body)
@@ -1,253 +1,2192 @@
 """Thunder Compute module for running GPU workloads"""
-from typing import Annotated, List, Dict, Any
+from importlib import metadata
+from typing import Annotated, List, Dict, Any, Awaitable, Callable, ContextManager, Mapping, Self
+from urllib.parse import urlencode, urlparse
+import posixpath
+import asyncio
+import dataclasses
+import hashlib
 import json
 import os
-from time import time
+import re
+import signal
+import uuid
+from time import monotonic, time
 import traceback
 
 import dagger
 from dagger import Doc, dag, function, Module
 
+from .errors import (
+    DestroyGuardError,
+    DrainError,
+    EngineProbeError,
+    GroupNotReadyError,
+    InstanceLimitReachedError,
+    InvalidBaseURLError,
+    InvalidResponseError,
+    PollTimeoutError,
+    PostReadyHookError,
+    ThunderAPIError,
+    TokenRequiredError,
+    UnsupportedEndpointError,
+    WaitTimeoutError,
+)
+from .poller import Poller
+from .request_ids import current_request_id, log_prefix, use_request_id
+from .models import (
+    Deployment,
+    DestroyReport,
+    DiagnosticStep,
+    Diagnostics,
+    Instance,
+    InstanceMetrics,
+    InstanceType,
+    Label,
+    MatrixResult,
+    Quota,
+    Region,
+    Volume,
+    normalize_status,
+    parse_instance,
+    parse_instance_metrics,
+    parse_instance_type,
+    parse_quota,
+    parse_region,
+    parse_response,
+    require_field,
+)
+
+# HTTP statuses the API uses for endpoints it doesn't implement
+UNSUPPORTED_STATUS_CODES = (404, 405, 501)
+
 # Get API endpoint from environment variable or use default
 DEFAULT_API_ENDPOINT = "https://dagger.thundercompute.com/api"
 THUNDER_API_ENDPOINT = os.getenv("THUNDER_API_ENDPOINT", DEFAULT_API_ENDPOINT)
 
+# Number of times the create request is sent before giving up on transient failures
+CREATE_ATTEMPTS = 3
+
+# Seconds between create attempts
+CREATE_RETRY_DELAY = 3
+
+# What destroy does when the drain command fails
+DRAIN_ABORT = "abort"
+DRAIN_PROCEED = "proceed"
+
+# Longest label key or value Thunder accepts
+MAX_LABEL_LENGTH = 63
+
+# Limits Thunder places on instance names and descriptions
+INSTANCE_NAME_PATTERN = re.compile(r'[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?')
+MAX_DESCRIPTION_LENGTH = 255
+
+# What Thunder private network IDs look like, e.g. net-3f9a2c
+NETWORK_ID_PATTERN = re.compile(r'[A-Za-z0-9][A-Za-z0-9_-]{0,127}')
+
+# Thunder rejects boot scripts larger than this
+MAX_USER_DATA_BYTES = 16 * 1024
+
+# Timeouts in seconds. The request timeout bounds each individual API call, the
+# create timeout bounds only the create POST and its retries (it can hang on its own), and the
+# deploy timeout bounds the whole deploy: create, readiness wait and SSH setup.
+DEFAULT_REQUEST_TIMEOUT = 30
+DEFAULT_CREATE_TIMEOUT = 60
+DEFAULT_DEPLOY_TIMEOUT = 600
+
+# Timeouts in seconds for an instance to reach a status. Provisioning to running
+# is slow while stopping is quick, so each target status gets its own bound.
+DEFAULT_RUNNING_TIMEOUT = 300
+DEFAULT_STOPPED_TIMEOUT = 60
+DEFAULT_STATUS_TIMEOUT = 300
+
+# GPU types Thunder offers instances with, on top of any in its instance type catalog
+GPU_TYPES = ("t4", "a100", "a100xl")
+
+# Statuses that mean a deployed instance is ready for use
+DEFAULT_READY_STATES = ("running",)
+
+# Above this many IDs, get-instances lists every instance once instead of
+# fetching each one
+DEFAULT_BULK_LOOKUP_THRESHOLD = 5
+
+# Statuses of instances that count towards client-side instance limits
+ACTIVE_STATUSES = ("running", "pending")
+
+# Seconds between status polls
+STATUS_POLL_INTERVAL = 3
+
+# Seconds to wait for the probed port to accept a connection
+ENGINE_PROBE_TIMEOUT = 5
+
+# Backoff between engine probe attempts, in seconds: the first delay, doubled up to the cap
+ENGINE_PROBE_RETRY_DELAY = 1
+ENGINE_PROBE_MAX_RETRY_DELAY = 10
+
+# Ways of checking that an instance's engine is up
+HEALTH_PROBES = ("tcp", "http", "grpc")
+DEFAULT_HEALTH_PATH = "/healthz"
+
+# What a client sends to open an HTTP/2 connection with prior knowledge, as gRPC does
+HTTP2_PREFACE = b"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+HTTP2_SETTINGS_FRAME = 0x04
+
+# Instance filters sent to the API as query parameters, and the instance field each one matches
+SERVER_SIDE_FILTERS = {"status": "status", "type": "gpu_type", "region": "region"}
+
+# Instance filters only ever applied to the listed instances, label.<key> filters aside
+CLIENT_SIDE_FILTERS = ("name",)
+
+# Upper bound on in-flight API requests, to stay within account rate limits
+DEFAULT_MAX_CONCURRENT_API_REQUESTS = 8
+
+# Dagger runs each function call in its own process, so one semaphore per limit
+# bounds every request made by the module instance serving the call
+_api_semaphores: Dict[int, asyncio.Semaphore] = {}
+
+# Tokens that came from the token provider, which are refreshed before every request
+_provided_tokens: set[str] = set()
+
+# Where the token provider command writes the token
+TOKEN_PROVIDER_FILE = "/tmp/thunder-token"
+
+# Cache volume holding responses to conditional GETs, one file per URL and token
+# with the ETag on the first line and the body after it
+ETAG_CACHE_VOLUME = "thunder-etag-cache"
+ETAG_CACHE_DIR = "/cache"
+
+# Most responses kept in the ETag cache
+ETAG_CACHE_SIZE = 32
+
+# Runs curl with the Authorization header built from the THUNDER_TOKEN secret,
+# then prints the body followed by the status code on its own line. With
+# THUNDER_CACHE_ENTRY set, the remembered ETag is sent as If-None-Match, a 304
+# is answered with the remembered body and a 200 with an ETag is remembered,
+# evicting the least recently used entries beyond THUNDER_CACHE_SIZE.
+CURL_SCRIPT = rf"""
+set -e
+entry=""
+if [ -n "$THUNDER_CACHE_ENTRY" ]; then
+    entry="{ETAG_CACHE_DIR}/$THUNDER_CACHE_ENTRY"
+    if cp "$entry" /tmp/cached 2>/dev/null; then
+        set -- "$@" -H "If-None-Match: $(head -n 1 /tmp/cached)"
+    fi
+fi
+curl -H "Authorization: Bearer $THUNDER_TOKEN" -o /tmp/response -w '%header{{etag}}\n%{{http_code}}' "$@" > /tmp/meta
+etag=$(head -n 1 /tmp/meta)
+status=$(tail -n 1 /tmp/meta)
+if [ -n "$entry" ]; then
+    if [ "$status" = 304 ] && [ -f /tmp/cached ]; then
+        tail -n +2 /tmp/cached > /tmp/response
+        status=200
+        touch "$entry" 2>/dev/null || true
+    elif [ "$status" = 200 ] && [ -n "$etag" ]; then
+        # Write to a hidden file first so concurrent readers never see half an entry
+        {{ printf '%s\n' "$etag"; cat /tmp/response; }} > "{ETAG_CACHE_DIR}/.$THUNDER_CACHE_ENTRY.$$"
+        mv "{ETAG_CACHE_DIR}/.$THUNDER_CACHE_ENTRY.$$" "$entry"
+    fi
+    ls -t {ETAG_CACHE_DIR} | tail -n +$((THUNDER_CACHE_SIZE + 1)) | while read -r old; do
+        rm -f "{ETAG_CACHE_DIR}/$old"
+    done
+fi
+cat /tmp/response
+printf '\n%s' "$status"
+"""
+
+# How much of each request and response body is logged when request logging is on
+DEFAULT_MAX_BODY_LOG_BYTES = 4096
+
+# Body fields replaced in request logs so secrets don't end up in CI output
+REDACTED_LOG_FIELDS = ("private_key", "token")
+
+def module_version() -> str:
+    """Version of the module, from the package metadata written when it is built, or dev when run from source"""
+    try:
+        return metadata.version("thunder")
+    except metadata.PackageNotFoundError:
+        return "dev"
+
+
+# Sent with every API request so Thunder can tell which module version made it
+MODULE_VERSION = module_version()
+USER_AGENT = f"thunder-dagger-module/{MODULE_VERSION}"
+
+
+def api_semaphore(limit: int) -> asyncio.Semaphore:
+    """Return the semaphore shared by all API requests made under the given concurrency limit"""
+    if limit not in _api_semaphores:
+        _api_semaphores[limit] = asyncio.Semaphore(limit)
+    return _api_semaphores[limit]
+
+
+def require_timeout(seconds: int) -> int:
+    """Return the timeout, raising ValueError if it isn't a positive number of seconds"""
+    if seconds <= 0:
+        raise ValueError(f"Timeout must be a positive number of seconds, got {seconds}")
+    return seconds
+
+
+# Every function that talks to the API takes the token as an optional last argument
+TokenArg = Annotated[str, Doc("Thunder API token, defaults to the one set with with-token")]
+
+def redact_fields(data: Any) -> Any:
+    """Replace the secret fields of decoded JSON with <redacted>, in nested objects and lists too"""
+    if isinstance(data, dict):
+        return {k: "<redacted>" if k in REDACTED_LOG_FIELDS else redact_fields(v) for k, v in data.items()}
+    if isinstance(data, list):
+        return [redact_fields(v) for v in data]
+    return data
+
+
+def log_body(body: str, max_bytes: int) -> str:
+    """Render a request or response body for the request log
+
+    Secret fields of a JSON body are redacted however deeply they are nested,
+    e.g. in every pod of a batch create response, and a body longer than
+    max_bytes is cut there and marked ...(truncated).
+    """
+    try:
+        data = json.loads(body)
+    except json.JSONDecodeError:
+        data = None
+    redacted = redact_fields(data)
+    if redacted != data:
+        body = json.dumps(redacted)
+    encoded = body.encode()
+    if len(encoded) <= max_bytes:
+        return body
+    return encoded[:max_bytes].decode(errors="ignore") + "...(truncated)"
+
+
+def require_token(token: str) -> str:
+    """Return the token, raising TokenRequiredError if it is missing or blank"""
+    if not token or not token.strip():
+        raise TokenRequiredError()
+    return token
+
+
+@dataclasses.dataclass
+class DeployOptions:
+    """Per-deploy settings layered over the module's configuration"""
+
+    gpu_type: str = "t4"
+    labels: dict[str, str] = dataclasses.field(default_factory=dict)
+    region: str = ""
+    zone: str = ""
+    # None means the volumes configured on the module
+    volumes: list[Volume] | None = None
+    # Tells apart the creates of one call that all use the module's idempotency key
+    idempotency_suffix: str = ""
+
+    def __post_init__(self):
+        self.gpu_type = self.gpu_type.strip()
+        if not self.gpu_type:
+            raise ValueError("GPU type is required")
+
+
+def parse_labels(labels: list[str] | None) -> dict[str, str]:
+    """Parse key=value label strings into a dict, raising ValueError on malformed entries"""
+    parsed = {}
+    for label in labels or []:
+        key, sep, value = label.partition("=")
+        if not sep or not key.strip():
+            raise ValueError(f"Invalid label {label!r}: expected key=value")
+        parsed[key.strip()] = value.strip()
+    return parsed
+
+
+def sanitize_label(value: str) -> str:
+    """Convert a string to what Thunder accepts in label keys and values
+
+    Letters are lowercased, anything other than letters, digits, '-' and '.'
+    becomes '-', leading and trailing separators are dropped and the result is
+    cut to MAX_LABEL_LENGTH characters.
+    """
+    value = re.sub(r'[^a-z0-9.-]', '-', value.lower())
+    return value[:MAX_LABEL_LENGTH].strip('-.')
+
+
+def labels_from_env(prefixes: list[str], environ: Mapping[str, str]) -> dict[str, str]:
+    """Build labels from environment variables whose names start with one of the prefixes"""
+    labels = {}
+    for name in sorted(environ):
+        if not any(name.startswith(prefix) for prefix in prefixes):
+            continue
+        key, value = sanitize_label(name), sanitize_label(environ[name])
+        if key and value:
+            labels[key] = value
+    return labels
+
+
+def token_secret(token: str) -> dagger.Secret:
+    """Wrap a token in a Dagger secret, named after its hash so different tokens never share one"""
+    return dag.set_secret(f"thunder-api-token-{hashlib.sha256(token.encode()).hexdigest()[:16]}", token)
+
+
+def validate_base_url(url: str) -> str:
+    """Return the API base URL without a trailing slash, raising InvalidBaseURLError if it is malformed
+
+    A bare host such as dagger.thundercompute.com gets the https scheme and the
+    /api path. A URL that already has a scheme keeps it rather than being
+    prefixed again, and gets the /api path only if it has no path of its own.
+    A URL whose http or https scheme isn't followed by // is rejected rather
+    than being taken for a bare host.
+    """
+    if not url or not url.strip():
+        raise InvalidBaseURLError(url, "URL is empty")
+    url = url.strip()
+    parsed = urlparse(url)
+    if parsed.scheme in ("http", "https") and not url[len(parsed.scheme) + 1:].startswith("//"):
+        raise InvalidBaseURLError(url, f"{parsed.scheme}: must be followed by //host")
+    if "://" not in url:
+        url = f"https://{url}"
+        parsed = urlparse(url)
+    if parsed.scheme not in ("http", "https"):
+        raise InvalidBaseURLError(url, "scheme must be http or https")
+    if not parsed.netloc:
+        raise InvalidBaseURLError(url, "host is missing")
+    url = url.rstrip("/")
+    if not parsed.path.strip("/"):
+        url = f"{url}/api"
+    return url
+
+
 @dagger.object_type
 class Thunder(Module):
     """Thunder provides integration with Thunder Compute for GPU workloads"""
 
+    token_secret: dagger.Secret | None = None
+    token_provider: dagger.Container | None = None
+    token_provider_args: list[str] = dataclasses.field(default_factory=list)
+    api_endpoint: str = THUNDER_API_ENDPOINT
+    request_timeout: int = DEFAULT_REQUEST_TIMEOUT
+    create_timeout: int = DEFAULT_CREATE_TIMEOUT
+    deploy_timeout: int = DEFAULT_DEPLOY_TIMEOUT
+    running_timeout: int = DEFAULT_RUNNING_TIMEOUT
+    stopped_timeout: int = DEFAULT_STOPPED_TIMEOUT
+    destroy_guard_key: str = ""
+    destroy_guard_value: str = ""
+    event_webhook: str = ""
+    user_data: str = ""
+    idempotency_key: str = ""
+    volumes: list[Volume] = dataclasses.field(default_factory=list)
+    max_concurrent_api_requests: int = DEFAULT_MAX_CONCURRENT_API_REQUESTS
+    wait_for_ready: bool = True
+    ready_states: list[str] = dataclasses.field(default_factory=lambda: list(DEFAULT_READY_STATES))
+    default_labels: list[str] = dataclasses.field(default_factory=list)
+    region: str = ""
+    zone: str = ""
+    network_id: str = ""
+    prefer_private_host: bool = False
+    early_return: bool = False
+    hourly_rates: list[str] = dataclasses.field(default_factory=list)
+    request_id: str = ""
+    name: str = ""
+    description: str = ""
+    context_label_prefixes: list[str] = dataclasses.field(default_factory=list)
+    context_env: list[str] = dataclasses.field(default_factory=list)
+    drain_container: dagger.Container | None = None
+    drain_args: list[str] = dataclasses.field(default_factory=list)
+    drain_failure_policy: str = DRAIN_ABORT
+    local_port: int = 0
+    bulk_lookup_threshold: int = DEFAULT_BULK_LOOKUP_THRESHOLD
+    health_probe: str = "tcp"
+    health_path: str = DEFAULT_HEALTH_PATH
+    health_port: int = 0
+    engine_port_attempts: int = 1
+    log_requests: bool = False
+    max_body_log_bytes: int = DEFAULT_MAX_BODY_LOG_BYTES
+    post_ready_hook: dagger.Container | None = None
+    post_ready_hook_args: list[str] = dataclasses.field(default_factory=list)
+    destroy_on_failure: bool = False
+
     @function
-    async def deploy(self, token: Annotated[str, Doc("Thunder API token")], gpu_type: Annotated[str, Doc("GPU type")] = "t4") -> str:
-        """Deploy a new Thunder compute instance with a Dagger runner"""
-        if gpu_type not in ['t4', 'a100', 'a100xl']:
-            gpu_type = 't4'
+    def version(self) -> str:
+        """Version of the module, also sent to Thunder with every API request"""
+        return MODULE_VERSION
 
-        container = (
-            dag.container()
+    @function
+    def with_request_id(self, id: Annotated[str, Doc("Request ID to send with every API request")]) -> Self:
+        """Use this request ID for every deploy and destroy instead of generating one per operation
+
+        Every API request made for an operation carries its ID in the
+        X-Request-ID header, and the ID appears in request logs and API errors,
+        so a failed multi-step deploy can be correlated with Thunder's logs.
+        """
+        if not id.strip():
+            raise ValueError("Request ID is empty")
+        self.request_id = id.strip()
+        return self
+
+    def _operation(self) -> ContextManager[str]:
+        """Scope a deploy or destroy under a request ID, reusing the one of an enclosing operation"""
+        return use_request_id(self.request_id)
+
+    @function
+    def with_token(self, token: Annotated[dagger.Secret, Doc("Thunder API token")]) -> Self:
+        """Use this token for every function called without an explicit token"""
+        self.token_secret = token
+        return self
+
+    @function
+    async def with_token_file(self, file: Annotated[dagger.File, Doc("File containing the Thunder API token")]) -> Self:
+        """Read the token from a file, e.g. a mounted Kubernetes secret, for every function called without an explicit token
+
+        Surrounding whitespace and newlines are trimmed. The token is stored as
+        a secret and handed to API requests as one, so it never appears in exec
+        arguments or logs.
+        """
+        token = require_token((await file.contents()).strip())
+        self.token_secret = token_secret(token)
+        return self
+
+    @function
+    def with_token_provider(
+        self,
+        container: Annotated[dagger.Container, Doc("Container to run the provider command in")],
+        args: Annotated[list[str], Doc("Command that writes a fresh token to $THUNDER_TOKEN_FILE")],
+    ) -> Self:
+        """Fetch a fresh token from a command before every API request, for short-lived rotating tokens
+
+        The command must write the token to the file named by THUNDER_TOKEN_FILE
+        rather than print it, so it never shows up in logs. If the API rejects a
+        token with HTTP 401 the provider is run once more before failing. An
+        explicit token argument still takes precedence.
+        """
+        if not args:
+            raise ValueError("Token provider command is required")
+        self.token_provider = container
+        self.token_provider_args = list(args)
+        return self
+
+    async def _provide_token(self) -> str:
+        """Run the token provider and return the token it wrote"""
+        token = await (
+            self.token_provider
+            .with_env_variable("THUNDER_TOKEN_FILE", TOKEN_PROVIDER_FILE)
             .with_env_variable("CACHEBUSTER", str(time()))
-            .from_("alpine:latest")
-            .with_exec(["apk", "add", "--no-cache", "curl"])
+            .with_exec(self.token_provider_args)
+            .file(TOKEN_PROVIDER_FILE)
+            .contents()
         )
+        token = require_token(token.strip())
+        _provided_tokens.add(token)
+        return token
+
+    async def _token(self, token: str) -> str:
+        """Resolve the token passed to a function, falling back to the token provider and then to the one set with with_token"""
+        if token and token.strip():
+            return token
+        if self.token_provider is not None:
+            return await self._provide_token()
+        if self.token_secret is not None:
+            return require_token((await self.token_secret.plaintext()).strip())
+        raise TokenRequiredError()
+
+    @function
+    def with_base_url(self, url: Annotated[str, Doc("Thunder API host or base URL, e.g. dagger.thundercompute.com")]) -> Self:
+        """Use a different Thunder API endpoint"""
+        self.api_endpoint = validate_base_url(url)
+        return self
+
+    @function
+    def with_request_timeout(self, seconds: Annotated[int, Doc("Timeout for each API request, in seconds")]) -> Self:
+        """Bound every individual Thunder API request"""
+        self.request_timeout = require_timeout(seconds)
+        return self
+
+    @function
+    def with_request_logging(self, enabled: Annotated[bool, Doc("Whether to log every API request and response")]) -> Self:
+        """Log the method, path, status and body of every Thunder API request, for debugging
+
+        Bodies are cut to the size set with with-max-body-log-bytes, and the
+        token, private keys and tokens in bodies are never logged.
+        """
+        self.log_requests = enabled
+        return self
+
+    @function
+    def with_max_body_log_bytes(self, n: Annotated[int, Doc("Most bytes of each body to log")]) -> Self:
+        """Cut request and response bodies in the request log to n bytes, marking them ...(truncated)"""
+        if n < 0:
+            raise ValueError(f"Body log size must not be negative, got {n}")
+        self.max_body_log_bytes = n
+        return self
+
+    @function
+    def with_create_timeout(self, seconds: Annotated[int, Doc("Timeout for the create request, in seconds")]) -> Self:
+        """Bound only the create request, so a stuck create fails fast without shortening the readiness wait"""
+        self.create_timeout = require_timeout(seconds)
+        return self
+
+    @function
+    def with_deploy_timeout(self, seconds: Annotated[int, Doc("Timeout for the whole deploy, in seconds")]) -> Self:
+        """Bound the whole deploy, from the create request until the runner is ready"""
+        self.deploy_timeout = require_timeout(seconds)
+        return self
+
+    @function
+    def with_running_timeout(self, seconds: Annotated[int, Doc("Timeout for an instance to become running, in seconds")]) -> Self:
+        """Bound how long to wait for an instance to become running"""
+        self.running_timeout = require_timeout(seconds)
+        return self
+
+    @function
+    def with_stopped_timeout(self, seconds: Annotated[int, Doc("Timeout for an instance to become stopped, in seconds")]) -> Self:
+        """Bound how long to wait for an instance to become stopped"""
+        self.stopped_timeout = require_timeout(seconds)
+        return self
+
+    @function
+    async def wait_for_status(
+        self,
+        instance_id: Annotated[str, Doc("Instance ID to wait for")],
+        status: Annotated[str, Doc("Status to wait for, e.g. running or stopped")],
+        timeout: Annotated[int, Doc("Timeout in seconds, defaults to the timeout configured for the status")] = 0,
+        token: TokenArg = "",
+    ) -> Instance:
+        """Wait until an instance reports the given status and return it"""
+        token = await self._token(token)
+        if not instance_id:
+            raise ValueError("Instance ID is required")
+
+        target = normalize_status(status)
+        status_data, _ = await self._wait_for_status(
+            token, instance_id, [target], require_timeout(timeout) if timeout else self._status_timeout(target),
+        )
+        return parse_instance(status_data)
+
+    def _status_timeout(self, status: str) -> int:
+        """Default timeout for an instance to reach the given status"""
+        if status == "running":
+            return self.running_timeout
+        if status == "stopped":
+            return self.stopped_timeout
+        return DEFAULT_STATUS_TIMEOUT
+
+    @function
+    async def deploy(
+        self,
+        gpu_type: Annotated[str, Doc("GPU type")] = "t4",
+        labels: Annotated[list[str] | None, Doc("Labels to attach, as key=value")] = None,
+        token: TokenArg = "",
+    ) -> Deployment:
+        """Deploy a new Thunder compute instance with a Dagger runner
+
+        The returned deployment's setup-script configures SSH and points Dagger
+        at the runner, e.g. dagger call deploy setup-script | bash. Its
+        instance-id, host and port can be chained the same way.
+        """
+        token = await self._token(token)
+        if not self.wait_for_ready:
+            raise ValueError("deploy configures SSH for a ready instance, use deploy-instance to skip the readiness wait")
+        instance, setup_instructions = await self._provision(token, DeployOptions(gpu_type, parse_labels(labels)))
+        return Deployment(
+            instance=instance, setup_script=setup_instructions, runner_host=self._runner_host(instance),
+        )
+
+    @function
+    async def deploy_instance(
+        self,
+        gpu_type: Annotated[str, Doc("GPU type")] = "t4",
+        labels: Annotated[list[str] | None, Doc("Labels to attach, as key=value")] = None,
+        token: TokenArg = "",
+    ) -> Instance:
+        """Deploy a new Thunder compute instance and return it
+
+        The instance is running when returned, unless the readiness wait is
+        disabled with with-wait-for-ready. In that case it is returned straight
+        after the create request with whatever status Thunder reported, and its
+        host may be empty until it is ready. With with-early-return it is
+        returned once it has a host, possibly still pending.
+        """
+        token = await self._token(token)
+        options = DeployOptions(gpu_type, parse_labels(labels))
+        if not self.wait_for_ready:
+            with self._operation():
+                instance, _ = await self._create_instance(token, options)
+                await self._price_instance(token, instance)
+            return instance
+        instance, _ = await self._provision(token, options, configure_ssh=False, early=self.early_return)
+        return instance
+
+    @function
+    def with_early_return(self, enabled: Annotated[bool, Doc("Whether deploy-instance returns as soon as the instance has a host")]) -> Self:
+        """Make deploy-instance return as soon as the instance has a host, even if it is still pending
+
+        Setup that doesn't need the runner can then overlap with provisioning.
+        Call wait-until-ready with the instance ID once the runner is needed:
+        the instance may not accept connections before it returns. The health
+        probe and the post-ready hook run in wait-until-ready rather than in
+        deploy-instance.
+        """
+        self.early_return = enabled
+        return self
+
+    @function
+    async def wait_for_group_ready(
+        self,
+        group_label: Annotated[str, Doc("Label shared by the group, as key=value")],
+        timeout: Annotated[int, Doc("Timeout in seconds, defaults to the running timeout")] = 0,
+        token: TokenArg = "",
+    ) -> list[Instance]:
+        """Wait until every instance carrying a label is ready and return them, e.g. to adopt a group deployed elsewhere
+
+        The instances are listed again on every poll, so instances joining the
+        group while waiting are waited for too. The timeout error names the
+        instances that weren't ready.
+        """
+        token = await self._token(token)
+        labels = parse_labels([group_label])
+        if len(labels) != 1:
+            raise ValueError(f"Invalid group label {group_label!r}: expected key=value")
+        (key, value), = labels.items()
+        timeout = require_timeout(timeout) if timeout else self.running_timeout
+        ready_states = self._ready_states()
+        group: list[Instance] = []
+
+        async def all_ready() -> bool:
+            nonlocal group
+            group = await self.list_instances_filtered([f"label.{key}={value}"], token=token)
+            pending = [instance.instance_id for instance in group if instance.status not in ready_states]
+            print(f"{log_prefix()}{len(group) - len(pending)} of {len(group)} instances labelled {key}={value} are ready")
+            return bool(group) and not pending
 
         try:
-            # Create pod and store raw response
-            raw_response = await (
-                container
-                .with_env_variable("CACHEBUSTER", str(time()))
-                .with_exec([
-                    "sh", "-c",
-                    f"curl -s -X POST '{THUNDER_API_ENDPOINT}/pods/{gpu_type}/1' "
-                    f"-H 'Authorization: Bearer {token}' "
-                ])
-                .stdout()
+            await Poller(timeout, STATUS_POLL_INTERVAL).wait(all_ready)
+        except PollTimeoutError:
+            pending = [instance.instance_id for instance in group if instance.status not in ready_states]
+            raise GroupNotReadyError(f"{key}={value}", timeout, pending)
+        return group
+
+    @function
+    async def wait_until_ready(
+        self,
+        instance_id: Annotated[str, Doc("ID of an instance deployed with early return")],
+        token: TokenArg = "",
+    ) -> Instance:
+        """Finish a deploy that returned early: wait for the instance to be ready, probe its engine and run the post-ready hook"""
+        token = await self._token(token)
+        if not instance_id:
+            raise ValueError("Instance ID is required")
+
+        instance = await self.get_instance(instance_id, token=token)
+        instance, _ = await self._become_ready(token, instance, "", configure_ssh=False)
+        return instance
+
+    async def deploy_with_cleanup(
+        self,
+        gpu_type: str = "t4",
+        labels: list[str] | None = None,
+        token: str = "",
+    ) -> tuple[Instance, Callable[[], Awaitable[None]]]:
+        """Deploy an instance and return it with a function that destroys it
+
+        For Python code built on the module, so instances can't leak::
+
+            instance, cleanup = await thunder.deploy_with_cleanup()
+            try:
+                ...
+            finally:
+                await cleanup()
+
+        The cleanup function can be called any number of times, concurrently or
+        not, and succeeds if the instance is already gone.
+        """
+        token = await self._token(token)
+        instance = await self.deploy_instance(gpu_type=gpu_type, labels=labels, token=token)
+        lock = asyncio.Lock()
+        destroyed = False
+
+        async def cleanup() -> None:
+            nonlocal destroyed
+            async with lock:
+                if destroyed:
+                    return
+                try:
+                    await self.destroy(instance.instance_id, token=token)
+                except ThunderAPIError as e:
+                    if e.status_code != 404:
+                        raise
+                destroyed = True
+
+        return instance, cleanup
+
+    @function
+    async def deploy_and_watch(
+        self,
+        gpu_type: Annotated[str, Doc("GPU type")] = "t4",
+        labels: Annotated[list[str] | None, Doc("Labels to attach, as key=value")] = None,
+        token: TokenArg = "",
+    ) -> str:
+        """Deploy a Dagger runner for the length of the session and destroy it when the call is cancelled
+
+        The output never includes the SSH private key. To connect to the
+        runner from the session, deploy it with deploy, run its setup script
+        and then watch it instead.
+        """
+        token = await self._token(token)
+        instance, _ = await self._provision(token, DeployOptions(gpu_type, parse_labels(labels)), configure_ssh=False)
+        return await self._watch(token, instance)
+
+    @function
+    async def watch(
+        self,
+        instance_id: Annotated[str, Doc("ID of the instance to watch")],
+        token: TokenArg = "",
+    ) -> str:
+        """Block until the call is cancelled, then destroy the instance
+
+        Pair it with deploy for an interactive session: run the setup script
+        deploy returns, then watch the instance so it is destroyed when the
+        session ends.
+        """
+        token = await self._token(token)
+        if not instance_id:
+            raise ValueError("Instance ID is required")
+        return await self._watch(token, await self.get_instance(instance_id, token=token))
+
+    async def _watch(self, token: str, instance: Instance) -> str:
+        """Print the runner host, wait for the call to be cancelled and destroy the instance"""
+        instance_id = instance.instance_id
+        runner_host = f"ssh://root@{self._runner_host(instance)}:{instance.port}"
+
+        loop = asyncio.get_running_loop()
+        stop = asyncio.Event()
+        handled_signals = []
+        for sig in (signal.SIGINT, signal.SIGTERM):
+            try:
+                loop.add_signal_handler(sig, stop.set)
+                handled_signals.append(sig)
+            except (NotImplementedError, RuntimeError):
+                # Signal handlers can only be installed from the main thread
+                pass
+
+        try:
+            print(f"export _EXPERIMENTAL_DAGGER_RUNNER_HOST={runner_host}", flush=True)
+            print(f"{log_prefix()}Watching Thunder instance {instance_id}, cancel the call to destroy it", flush=True)
+            await stop.wait()
+        finally:
+            for sig in handled_signals:
+                loop.remove_signal_handler(sig)
+            # Shield the teardown so a second cancellation doesn't leave the instance running
+            await asyncio.shield(self.destroy(instance_id, token=token))
+
+        return f"Destroyed Thunder instance {instance_id}"
+
+    @function
+    async def clone_instance(
+        self,
+        source_id: Annotated[str, Doc("ID of the instance to clone")],
+        token: TokenArg = "",
+    ) -> Instance:
+        """Deploy a new instance with the same GPU type, region, zone, labels and volumes as an existing one
+
+        The clone is labelled cloned-from=<source ID> and is ready when
+        returned. Volumes that can only be attached to one instance at a time
+        will make the clone fail while the source is still running.
+        """
+        token = await self._token(token)
+        if not source_id:
+            raise ValueError("Source instance ID is required")
+
+        source = await self.get_instance(source_id, token=token)
+        if not source.gpu_type:
+            raise ValueError(f"Thunder didn't report the GPU type of instance {source.instance_id or source_id}, so it can't be cloned")
+        labels = {label.key: label.value for label in source.labels}
+        labels['cloned-from'] = source.instance_id
+        options = DeployOptions(
+            gpu_type=source.gpu_type,
+            labels=labels,
+            region=source.region,
+            zone=source.zone,
+            volumes=[Volume(id=v.id, mount_path=v.mount_path) for v in source.volumes],
+        )
+
+        instance, _ = await self._provision(token, options, configure_ssh=False)
+        return instance
+
+    @function
+    async def runner_service(
+        self,
+        instance_id: Annotated[str, Doc("ID of a running instance")],
+        token: TokenArg = "",
+    ) -> dagger.Service:
+        """Expose a runner as a service that can be bound into containers
+
+        The service forwards the port set with with-local-port, or the
+        instance's SSH port by default, to the instance's SSH port, which is
+        how Dagger reaches the runner's engine. Give each runner bound into the
+        same pipeline its own local port to avoid conflicts.
+        """
+        token = await self._token(token)
+        instance = await self.get_instance(instance_id, token=token)
+        host = self._runner_host(instance)
+        if not host or not instance.port:
+            raise ValueError(f"Thunder instance {instance_id} has no host yet, wait for it to be running")
+
+        local_port = self.local_port or instance.port
+        return (
+            dag.container()
+            .from_("alpine:latest")
+            .with_exec(["apk", "add", "--no-cache", "socat"])
+            .with_exposed_port(local_port)
+            .with_default_args([
+                "socat",
+                f"TCP-LISTEN:{local_port},fork,reuseaddr",
+                f"TCP:{host}:{instance.port}",
+            ])
+            .as_service()
+        )
+
+    @function
+    async def deploy_batch(
+        self,
+        count: Annotated[int, Doc("Number of instances to deploy")],
+        gpu_type: Annotated[str, Doc("GPU type")] = "t4",
+        labels: Annotated[list[str] | None, Doc("Labels to attach, as key=value")] = None,
+        token: TokenArg = "",
+    ) -> list[Instance]:
+        """Deploy count identical instances with a single create request and wait for all of them to be ready
+
+        If the API doesn't create several instances per request, the
+        instances it didn't create are deployed with concurrent individual
+        requests instead. The log says which path was taken. If any instance
+        fails to become ready, all of them are destroyed before the error is
+        raised.
+        """
+        token = await self._token(token)
+        if count < 1:
+            raise ValueError(f"Instance count must be at least 1, got {count}")
+        options = DeployOptions(gpu_type, parse_labels(labels))
+
+        with self._operation():
+            created: list[tuple[Instance, str]] = []
+
+            async def deploy_all() -> list[Instance]:
+                status_code, raw_response = await self._create_pod(token, options, count)
+                if status_code not in UNSUPPORTED_STATUS_CODES:
+                    if status_code >= 400:
+                        raise ThunderAPIError.from_response("create Thunder instances", status_code, raw_response)
+                    response_data = parse_response(raw_response, "create")
+                    entries = response_data['pods'] if isinstance(response_data.get('pods'), list) else [response_data]
+                    created.extend(self._created_instance(entry, raw_response, options) for entry in entries)
+
+                missing = count - len(created)
+                if not missing:
+                    print(f"{log_prefix()}Created {count} Thunder instances with a single batch request")
+                else:
+                    print(
+                        f"{log_prefix()}Thunder API created {len(created)} of {count} instances in one request, "
+                        f"creating the other {missing} individually"
+                    )
+                    # Each individual create is a different instance, so it gets its own key
+                    results = await asyncio.gather(
+                        *(
+                            self._create_instance(token, dataclasses.replace(options, idempotency_suffix=str(i)))
+                            for i in range(len(created), count)
+                        ),
+                        return_exceptions=True,
+                    )
+                    created.extend(r for r in results if not isinstance(r, BaseException))
+                    for result in results:
+                        if isinstance(result, BaseException):
+                            raise result
+
+                results = await asyncio.gather(
+                    *(self._become_ready(token, instance, key, configure_ssh=False) for instance, key in created),
+                    return_exceptions=True,
+                )
+                for result in results:
+                    if isinstance(result, BaseException):
+                        raise result
+                return [instance for instance, _ in results]
+
+            try:
+                instances = await asyncio.wait_for(deploy_all(), timeout=self.deploy_timeout)
+            except BaseException as e:
+                # Shield the cleanup so a cancellation doesn't leave instances running
+                await asyncio.shield(asyncio.gather(
+                    *(self._destroy_after_failure(token, instance.instance_id) for instance, _ in created),
+                ))
+                if isinstance(e, asyncio.TimeoutError):
+                    raise RuntimeError(
+                        f"Timed out after {self.deploy_timeout}s deploying {count} Thunder instances "
+                        f"(request ID {current_request_id()}), destroyed the {len(created)} created"
+                    )
+                raise
+
+            for instance in instances:
+                await self._price_instance(token, instance)
+            return instances
+
+    @function
+    async def deploy_if_under_limit(
+        self,
+        max_instances: Annotated[int, Doc("Maximum number of active instances on the account")],
+        gpu_type: Annotated[str, Doc("GPU type")] = "t4",
+        labels: Annotated[list[str] | None, Doc("Labels to attach, as key=value")] = None,
+        token: TokenArg = "",
+    ) -> Instance:
+        """Deploy an instance only if fewer than max_instances are active
+
+        Only running and pending instances count towards the limit. This is a
+        client-side guardrail: two concurrent calls can both see room and both
+        deploy, so rely on the account quota as the authoritative limit.
+        """
+        token = await self._token(token)
+        if max_instances < 1:
+            raise ValueError(f"Instance limit must be at least 1, got {max_instances}")
+
+        active = [i for i in await self.list_instances(token=token) if i.status in ACTIVE_STATUSES]
+        if len(active) >= max_instances:
+            raise InstanceLimitReachedError(len(active), max_instances)
+
+        return await self.deploy_instance(gpu_type=gpu_type, labels=labels, token=token)
+
+    @function
+    async def deploy_matrix(
+        self,
+        types: Annotated[list[str], Doc("GPU types to deploy")],
+        regions: Annotated[list[str] | None, Doc("Regions to deploy to, defaults to the configured region")] = None,
+        token: TokenArg = "",
+    ) -> list[MatrixResult]:
+        """Deploy one instance per GPU type and region combination, concurrently
+
+        Every instance is labelled with its instance-type and region, and each
+        result records how long it took to become ready so configurations can be
+        compared. If any deploy fails, every instance that was created is
+        destroyed before the error is raised, including ones that never
+        became ready.
+        """
+        token = await self._token(token)
+        if not types:
+            raise ValueError("At least one GPU type is required")
+        combinations = [(gpu_type, region) for gpu_type in types for region in regions or [self.region]]
+        # Every instance that was created, including ones whose deploy failed after the create
+        created: list[Instance] = []
+
+        async def deploy_one(index: int, gpu_type: str, region: str) -> MatrixResult:
+            labels = {'instance-type': gpu_type}
+            if region:
+                labels['region'] = region
+            options = DeployOptions(gpu_type, labels, region, idempotency_suffix=str(index))
+            started = monotonic()
+            instance, _ = await self._provision(token, options, configure_ssh=False, tracked=created)
+            return MatrixResult(
+                instance_type=gpu_type,
+                region=region,
+                provision_seconds=monotonic() - started,
+                instance=instance,
             )
 
-            # Parse the JSON response
-            response_data = json.loads(raw_response)
-            instance_id = response_data.get('instance_id')
-            private_key = response_data.get('private_key')
-            host = response_data.get('host')
-            port = response_data.get('port')
-
-            if not instance_id:
-                raise RuntimeError(f"Failed to get instance_id from API response: {raw_response}")
-            if not port:
-                raise RuntimeError(f"Failed to get port from API response: {raw_response}")
-
-            # Wait for pod to be ready
-            max_retries = 30
-            retry_count = 0
-            
-            # Create a container for status checks
-            status_container = (
-                container
-                .with_exec(["apk", "add", "--no-cache", "curl"])
+        # Outbound requests from every deploy share the module's concurrency limit
+        results = await asyncio.gather(
+            *(deploy_one(i, gpu_type, region) for i, (gpu_type, region) in enumerate(combinations)),
+            return_exceptions=True,
+        )
+
+        failures = [r for r in results if isinstance(r, BaseException)]
+        if failures:
+            for instance in created:
+                await self._destroy_after_failure(token, instance.instance_id)
+            raise RuntimeError(
+                f"{len(failures)} of {len(combinations)} matrix deploys failed, destroyed the {len(created)} created: {failures[0]}"
             )
-            
-            while retry_count < max_retries:
-                status_response = await (
-                    status_container
-                    .with_env_variable("CACHEBUSTER", str(time()))
-                    .with_exec([
-                        "sh", "-c",
-                        f'''sleep {3 if retry_count > 0 else 0} && '''
-                        f'''curl -s '{THUNDER_API_ENDPOINT}/pods/{instance_id.strip()}' '''
-                        f'''-H 'Authorization: Bearer {token}' '''
-                    ])
-                    .stdout()
+
+        return results
+
+    @function
+    async def ensure_runner(
+        self,
+        instance_id: Annotated[str, Doc("ID of the runner expected to be healthy")] = "",
+        gpu_type: Annotated[str, Doc("GPU type for a replacement runner")] = "t4",
+        token: TokenArg = "",
+    ) -> Instance:
+        """Keep exactly one healthy runner alive
+
+        Returns the given instance if it is running and passes the health
+        probe. Otherwise deploys a replacement, waits for it to be ready
+        and then destroys the unhealthy instance, so a reconciliation loop that
+        feeds the returned ID back in converges on a single healthy runner.
+        The old instance is only destroyed once its replacement is up, and a
+        failure to destroy it is reported but doesn't fail the call.
+        """
+        token = await self._token(token)
+
+        current = await self._find_instance(token, instance_id) if instance_id else None
+        if current is not None and current.status in self._ready_states() and self._runner_host(current):
+            if await self._engine_reachable(current):
+                return current
+            print(f"{log_prefix()}Thunder instance {instance_id} is running but its engine is unreachable, replacing it")
+        elif instance_id:
+            status = current.status if current is not None else "missing"
+            print(f"{log_prefix()}Thunder instance {instance_id} is {status}, replacing it")
+
+        replacement, _ = await self._provision(token, DeployOptions(gpu_type), configure_ssh=False)
+
+        if current is not None:
+            try:
+                await self.destroy(current.instance_id, token=token)
+            except Exception as e:
+                print(f"{log_prefix()}Failed to destroy unhealthy Thunder instance {current.instance_id}: {e}")
+
+        return replacement
+
+    @function
+    def with_health_probe(
+        self,
+        kind: Annotated[str, Doc("How to probe the engine: tcp, http or grpc")],
+        path: Annotated[str, Doc("Path to GET for the http probe")] = DEFAULT_HEALTH_PATH,
+        port: Annotated[int, Doc("Port to probe, required for http and grpc, defaults to the instance's SSH port for tcp")] = 0,
+    ) -> Self:
+        """Choose how to check that an instance's engine is up before it is considered ready
+
+        tcp only checks that the port accepts connections. http sends a GET
+        for the path and expects a 2xx answer. grpc opens an HTTP/2 connection
+        the way a gRPC client dials and expects the server's settings frame.
+        The instance's port is its SSH port, which speaks neither, so http and
+        grpc need the port of a service on the instance that does. The probe
+        runs once the instance is running and by ensure-runner on the runner
+        it is given.
+        """
+        kind = kind.strip().lower()
+        if kind not in HEALTH_PROBES:
+            raise ValueError(f"Health probe must be one of {', '.join(HEALTH_PROBES)}, got {kind!r}")
+        if not path.startswith("/"):
+            raise ValueError(f"Health path must start with /, got {path!r}")
+        if port and not 1 <= port <= 65535:
+            raise ValueError(f"Port must be between 1 and 65535, got {port}")
+        if kind != "tcp" and not port:
+            raise ValueError(f"The {kind} probe needs a port, the instance's own port is SSH")
+        self.health_probe = kind
+        self.health_path = path
+        self.health_port = port
+        return self
+
+    async def _engine_reachable(self, instance: Instance) -> bool:
+        """Whether the instance's engine passes the health probe"""
+        try:
+            await self._probe_engine(instance)
+        except EngineProbeError as e:
+            print(f"{log_prefix()}{e}")
+            return False
+        return True
+
+    @function
+    def with_engine_port_retries(self, n: Annotated[int, Doc("Number of health probe attempts")]) -> Self:
+        """Retry the health probe up to n attempts, with backoff, before declaring the engine unreachable
+
+        A running instance's engine may still be booting, so the first probe
+        can be refused. The delay starts at 1 second and doubles up to 10.
+        Retries during a deploy count towards the deploy timeout.
+        """
+        if n < 1:
+            raise ValueError(f"Engine port attempts must be at least 1, got {n}")
+        self.engine_port_attempts = n
+        return self
+
+    async def _probe_engine(self, instance: Instance) -> None:
+        """Run the health probe against the instance's engine, retrying as configured, raising EngineProbeError if it never passes"""
+        delay = ENGINE_PROBE_RETRY_DELAY
+        for attempt in range(1, self.engine_port_attempts + 1):
+            try:
+                await self._probe_engine_once(instance)
+                return
+            except EngineProbeError as e:
+                if attempt == self.engine_port_attempts:
+                    if attempt == 1:
+                        raise
+                    raise EngineProbeError(e.instance_id, e.probe, e.target, f"{e.reason}, after {attempt} attempts")
+                print(f"{log_prefix()}Probe attempt {attempt}/{self.engine_port_attempts}: {e}, retrying in {delay}s")
+            await asyncio.sleep(delay)
+            delay = min(delay * 2, ENGINE_PROBE_MAX_RETRY_DELAY)
+
+    async def _probe_engine_once(self, instance: Instance) -> None:
+        """Run the health probe against the instance's engine once, raising EngineProbeError if it fails"""
+        host, port = self._runner_host(instance), self.health_port or instance.port
+        target = f"{host}:{port}"
+
+        def failed(reason: str) -> EngineProbeError:
+            return EngineProbeError(instance.instance_id, self.health_probe, target, reason)
+
+        try:
+            reader, writer = await asyncio.wait_for(
+                asyncio.open_connection(host, port),
+                timeout=ENGINE_PROBE_TIMEOUT,
+            )
+        except asyncio.TimeoutError:
+            raise failed(f"no connection after {ENGINE_PROBE_TIMEOUT}s")
+        except OSError as e:
+            raise failed(f"connection failed ({e})")
+
+        try:
+            if self.health_probe == "http":
+                writer.write(
+                    f"GET {self.health_path} HTTP/1.1\r\nHost: {target}\r\nConnection: close\r\n\r\n".encode()
                 )
+                await writer.drain()
+                status_line = await asyncio.wait_for(reader.readline(), timeout=ENGINE_PROBE_TIMEOUT)
+                parts = status_line.decode(errors="replace").split()
+                if len(parts) < 2 or not parts[0].startswith("HTTP/"):
+                    raise failed(f"GET {self.health_path} got no HTTP response")
+                if not parts[1].startswith("2"):
+                    raise failed(f"GET {self.health_path} returned HTTP {parts[1]}")
+            elif self.health_probe == "grpc":
+                # The preface is followed by an empty settings frame: no payload, no flags, stream 0
+                writer.write(HTTP2_PREFACE + bytes([0, 0, 0, HTTP2_SETTINGS_FRAME, 0, 0, 0, 0, 0]))
+                await writer.drain()
+                header = await asyncio.wait_for(reader.readexactly(9), timeout=ENGINE_PROBE_TIMEOUT)
+                if header[3] != HTTP2_SETTINGS_FRAME:
+                    raise failed("server did not answer the HTTP/2 handshake with a settings frame")
+        except asyncio.TimeoutError:
+            raise failed(f"no answer after {ENGINE_PROBE_TIMEOUT}s")
+        except asyncio.IncompleteReadError:
+            raise failed("connection closed during the handshake")
+        except OSError as e:
+            raise failed(f"connection failed ({e})")
+        finally:
+            writer.close()
+            try:
+                await writer.wait_closed()
+            except OSError:
+                pass
 
-                # Parse status response
-                status_data = json.loads(status_response)
-                print(f"Attempt {retry_count + 1}/{max_retries}: Status = {status_data.get('status', '')}")
-                status = status_data.get('status', '')
-
-                if status == "running":
-                    # Return both the environment variable and key information
-                    thunder_dir = os.path.join("~", ".thunder")
-                    keys_dir = os.path.join(thunder_dir, "keys")
-                    key_path = os.path.join(keys_dir, f"{instance_id}")
-                    
-                    # Wait for SSH to be ready and get host key
-                    host_key = await (
-                        container
-                        .from_("alpine:latest")
-                        .with_exec(["apk", "add", "--no-cache", "openssh-client"])
-                        .with_env_variable("CACHEBUSTER", str(time()))
-                        .with_exec([
-                            "sh", "-c",
-                            # Retry ssh-keyscan with proper error handling and port
-                            f'''for i in $(seq 1 10); do
-                                echo "Attempt $i: Scanning host {host} port {port}..."
-                                if KEY=$(ssh-keyscan -H -p {port} {host} 2>/dev/null); then
-                                    echo "$KEY"
-                                    exit 0
-                                fi
-                                sleep 3
-                            done
-                            echo "Failed to get host key after 10 attempts"
-                            exit 1'''
-                        ])
-                        .stdout()
-                    )
-                    
-                    # Create instructions for setting up the key
-                    setup_instructions = [
-                        f'mkdir -p {keys_dir}',
-                        f'chmod 700 {thunder_dir} {keys_dir}',
-                        f'cat > {key_path} << EOL\n{private_key}\nEOL',
-                        f'chmod 600 {key_path}',
-                        f'eval $(ssh-agent)',
-                        f'ssh-add {key_path}',
-                        'mkdir -p ~/.ssh',
-                        'chmod 700 ~/.ssh',
-                        # Add host key to known_hosts with port
-                        f'cat > ~/.ssh/known_hosts.tmp << EOL\n[{host}]:{port} {host_key}\nEOL',
-                        'cat ~/.ssh/known_hosts.tmp >> ~/.ssh/known_hosts',
-                        'rm ~/.ssh/known_hosts.tmp',
-                        'chmod 600 ~/.ssh/known_hosts',
-                        # Add SSH config with port
-                        f'''cat >> ~/.ssh/config << 'EOF'
+    @function
+    def with_ready_states(self, states: Annotated[list[str], Doc("Statuses that mean an instance is ready, e.g. running,ready")]) -> Self:
+        """Treat any of these statuses as ready when waiting for a deploy, compared case-insensitively"""
+        states = [normalize_status(state) for state in states]
+        if not states or not all(states):
+            raise ValueError("At least one non-empty ready state is required")
+        self.ready_states = states
+        return self
+
+    def _ready_states(self) -> list[str]:
+        """Normalized statuses that mean an instance is ready"""
+        return [normalize_status(state) for state in self.ready_states]
+
+    @function
+    def with_wait_for_ready(self, wait: Annotated[bool, Doc("Whether deploy-instance waits for the instance to be running")]) -> Self:
+        """Choose whether deploy-instance waits for readiness or returns right after the create request"""
+        self.wait_for_ready = wait
+        return self
+
+    async def _provision(
+        self,
+        token: str,
+        options: DeployOptions,
+        configure_ssh: bool = True,
+        early: bool = False,
+        tracked: list[Instance] | None = None,
+    ) -> tuple[Instance, str]:
+        """Create an instance, wait for it to be ready and return it with the runner setup instructions
+
+        With early set, the instance is returned as soon as it has a host, and
+        wait_until_ready finishes the deploy.
+
+        If the instance isn't ready in time, WaitTimeoutError carries the
+        instance that was created so the caller can clean it up. If the call is
+        cancelled instead, the instance is deleted so it doesn't go on to run
+        and be billed. The created instance is also added to tracked, whether
+        or not the deploy succeeds, for callers that clean up several deploys.
+        """
+        with self._operation():
+            created: list[Instance] = []
+            try:
+                instance, setup_instructions = await asyncio.wait_for(
+                    self._provision_instance(token, options, configure_ssh, created, early),
+                    timeout=self.deploy_timeout,
+                )
+            except asyncio.CancelledError:
+                if created:
+                    # Shield the delete so a second cancellation doesn't interrupt it
+                    await asyncio.shield(self._cancel_provision(token, created[0].instance_id))
+                raise
+            except asyncio.TimeoutError:
+                reason = f"Timed out after {self.deploy_timeout}s deploying Thunder instance (request ID {current_request_id()})"
+                if not created:
+                    raise RuntimeError(f"{reason} before it was created")
+                destroyed = self.destroy_on_failure and await self._destroy_after_failure(token, created[0].instance_id)
+                raise WaitTimeoutError(created[0], reason, destroyed)
+            finally:
+                if tracked is not None:
+                    tracked.extend(created)
+            await self._price_instance(token, instance)
+            return instance, setup_instructions
+
+    async def _cancel_provision(self, token: str, instance_id: str) -> None:
+        """Delete an instance whose deploy was cancelled, reporting whether that worked"""
+        try:
+            status_code, response = await self._api_request(token, "DELETE", f"/pods/{instance_id}")
+        except Exception as e:
+            print(f"{log_prefix()}Deploy cancelled, failed to delete Thunder instance {instance_id}: {e}")
+            return
+        if status_code >= 400 and status_code != 404:
+            print(f"{log_prefix()}Deploy cancelled, failed to delete Thunder instance {instance_id} (HTTP {status_code}): {response.strip()}")
+            return
+        print(f"{log_prefix()}Deploy cancelled, deleted Thunder instance {instance_id}")
+
+    async def _provision_instance(
+        self,
+        token: str,
+        options: DeployOptions,
+        configure_ssh: bool,
+        created: list[Instance],
+        early: bool = False,
+    ) -> tuple[Instance, str]:
+        try:
+            instance, private_key = await self._create_instance(token, options)
+            created.append(instance)
+            if early:
+                return await self._wait_for_host(token, instance), ""
+            return await self._become_ready(token, instance, private_key, configure_ssh)
+
+        except (ThunderAPIError, EngineProbeError, PostReadyHookError, WaitTimeoutError):
+            raise
+        except Exception as e:
+            traceback.print_exc()
+            raise RuntimeError(f"Failed to deploy Thunder instance (request ID {current_request_id()}): {str(e)}")
+
+    async def _become_ready(
+        self,
+        token: str,
+        instance: Instance,
+        private_key: str,
+        configure_ssh: bool,
+    ) -> tuple[Instance, str]:
+        """Wait for a created instance to be ready, probe it and run the post-ready hook"""
+        try:
+            instance = await self._wait_until_running(token, instance)
+            setup_instructions = await self._runner_setup(instance, private_key) if configure_ssh else ""
+            await self._probe_engine(instance)
+            if self.post_ready_hook is not None:
+                await self._run_post_ready_hook(instance)
+        except Exception as e:
+            if self.destroy_on_failure:
+                destroyed = await self._destroy_after_failure(token, instance.instance_id)
+                if destroyed and isinstance(e, WaitTimeoutError):
+                    raise WaitTimeoutError(e.instance, e.reason, destroyed=True)
+            raise
+        return instance, setup_instructions
+
+    async def _wait_for_host(self, token: str, instance: Instance) -> Instance:
+        """Poll a created instance until it has a host, whatever its status, and return its latest state"""
+        latest = instance
+
+        async def has_host() -> bool:
+            nonlocal latest
+            if self._runner_host(latest):
+                return True
+            status_code, status_response = await self._api_request(token, "GET", f"/pods/{instance.instance_id}")
+            if status_code >= 400:
+                raise ThunderAPIError.from_response("get Thunder instance status", status_code, status_response)
+            found = parse_instance(parse_response(status_response, "status"))
+            found.instance_id = found.instance_id or instance.instance_id
+            found.port = found.port or instance.port
+            found.region = found.region or instance.region
+            found.zone = found.zone or instance.zone
+            found.network_id = found.network_id or instance.network_id
+            found.name = found.name or instance.name
+            found.description = found.description or instance.description
+            found.labels = found.labels or instance.labels
+            found.volumes = found.volumes or instance.volumes
+            found.private_key = instance.private_key
+            latest = found
+            # A deploy timeout reports the created instance, so keep its status current
+            instance.status = found.status or instance.status
+            print(f"{log_prefix()}Status = {latest.status}, waiting for a host")
+            return bool(self._runner_host(latest))
+
+        try:
+            await Poller(self.running_timeout, STATUS_POLL_INTERVAL).wait(has_host)
+        except PollTimeoutError:
+            raise WaitTimeoutError(
+                latest, f"Timed out after {self.running_timeout}s waiting for Thunder instance {instance.instance_id} to get a host",
+            )
+        return latest
+
+    async def _create_instance(
+        self,
+        token: str,
+        options: DeployOptions,
+    ) -> tuple[Instance, str]:
+        """Send the create request and return the new instance with its SSH private key"""
+        if self.user_data and token in self.user_data:
+            raise ValueError("User data must not contain the Thunder API token")
+
+        # Create pod and store raw response
+        status_code, raw_response = await self._create_pod(token, options)
+        if status_code >= 400:
+            raise ThunderAPIError.from_response("create Thunder instance", status_code, raw_response)
+
+        # Parse the JSON response
+        return self._created_instance(parse_response(raw_response, "create"), raw_response, options)
+
+    def _created_instance(
+        self,
+        response_data: dict[str, Any],
+        raw_response: str,
+        options: DeployOptions,
+    ) -> tuple[Instance, str]:
+        """Build a newly created instance from its entry in a create response, returning it with its SSH private key"""
+        instance_id = require_field(response_data, 'instance_id', raw_response, "create")
+        private_key = require_field(response_data, 'private_key', raw_response, "create")
+        require_field(response_data, 'port', raw_response, "create")
+
+        instance = parse_instance(response_data)
+        instance.gpu_type = instance.gpu_type or options.gpu_type
+        # The create response may not echo the placement, so record what was asked for
+        region, zone = self._placement(options)
+        instance.region = instance.region or region
+        instance.zone = instance.zone or zone
+        instance.network_id = instance.network_id or self.network_id
+        # Likewise for what the create request attached to the instance
+        requested = self._create_body(options)
+        instance.name = instance.name or requested.get('name', "")
+        instance.description = instance.description or requested.get('description', "")
+        instance.labels = instance.labels or [Label(key=k, value=v) for k, v in requested.get('labels', {}).items()]
+        instance.volumes = instance.volumes or [
+            Volume(id=v['id'], mount_path=v['mount_path']) for v in requested.get('volumes', [])
+        ]
+        instance.private_key = dag.set_secret(f"thunder-ssh-key-{instance_id}", private_key)
+        return instance, private_key
+
+    async def _wait_until_running(self, token: str, instance: Instance) -> Instance:
+        """Poll the instance until it is running and return its latest state"""
+        status_data, status_response = await self._wait_for_status(
+            token, instance.instance_id, self._ready_states(), self.running_timeout, seen=instance,
+        )
+
+        running = parse_instance(status_data)
+        running.instance_id = running.instance_id or instance.instance_id
+        running.port = running.port or instance.port
+        running.gpu_type = running.gpu_type or instance.gpu_type
+        running.region = running.region or instance.region
+        running.zone = running.zone or instance.zone
+        running.network_id = running.network_id or instance.network_id
+        running.name = running.name or instance.name
+        running.description = running.description or instance.description
+        running.labels = running.labels or instance.labels
+        running.volumes = running.volumes or instance.volumes
+        running.private_key = instance.private_key
+        # The create response may predate host assignment, so prefer the latest one
+        running.host = running.host or instance.host
+        running.public_host = running.public_host or instance.public_host
+        running.private_host = running.private_host or instance.private_host
+        if not self._runner_host(running):
+            raise InvalidResponseError("status", "running instance has no host", status_response)
+        return running
+
+    async def _wait_for_status(
+        self,
+        token: str,
+        instance_id: str,
+        targets: list[str],
+        timeout: int,
+        seen: Instance | None = None,
+    ) -> tuple[dict[str, Any], str]:
+        """Poll the instance until it reports one of the target statuses, returning the decoded and raw status response
+
+        With seen given, its status is kept up to date with every poll, so a
+        deploy that times out while polling reports the last status.
+        """
+        target = " or ".join(targets)
+        attempt = 0
+        last: tuple[dict[str, Any], str] = ({}, "")
+
+        async def reached() -> bool:
+            nonlocal attempt, last
+            attempt += 1
+            status_code, status_response = await self._api_request(token, "GET", f"/pods/{instance_id}")
+            if status_code >= 400:
+                raise ThunderAPIError.from_response("get Thunder instance status", status_code, status_response)
+
+            # Parse status response
+            status_data = parse_response(status_response, "status")
+            status = normalize_status(require_field(status_data, 'status', status_response, "status"))
+            print(f"{log_prefix()}Attempt {attempt}: Status = {status}, waiting for {target}")
+            last = status_data, status_response
+            if seen is not None:
+                seen.status = status
+            return status in targets
+
+        try:
+            await Poller(timeout, STATUS_POLL_INTERVAL).wait(reached)
+        except PollTimeoutError:
+            instance = parse_instance(last[0])
+            instance.instance_id = instance.instance_id or instance_id
+            raise WaitTimeoutError(instance, f"Timed out after {timeout}s waiting for Thunder instance {instance_id} to be {target}")
+        return last
+
+    @function
+    def with_post_ready_hook(
+        self,
+        container: Annotated[dagger.Container, Doc("Container to run the hook command in")],
+        args: Annotated[list[str], Doc("Hook command to run")],
+    ) -> Self:
+        """Run a command once a deployed instance is ready, before the deploy returns, e.g. to warm caches or pre-pull images
+
+        The command runs in the container with THUNDER_INSTANCE_ID,
+        THUNDER_INSTANCE_HOST and THUNDER_INSTANCE_PORT set, and with the
+        instance's SSH private key in the THUNDER_INSTANCE_SSH_KEY secret
+        variable. If it fails the deploy fails, and the instance is destroyed if with-destroy-on-failure
+        is set.
+        """
+        if not args:
+            raise ValueError("Post-ready hook command is required")
+        self.post_ready_hook = container
+        self.post_ready_hook_args = list(args)
+        return self
+
+    @function
+    def with_destroy_on_failure(self, destroy: Annotated[bool, Doc("Whether to destroy an instance whose deploy failed")]) -> Self:
+        """Choose whether a deploy that fails after the instance was created destroys it rather than leaving it running"""
+        self.destroy_on_failure = destroy
+        return self
+
+    async def _run_post_ready_hook(self, instance: Instance) -> None:
+        """Run the post-ready hook against a ready instance"""
+        hook = (
+            self.post_ready_hook
+            .with_env_variable("THUNDER_INSTANCE_ID", instance.instance_id)
+            .with_env_variable("THUNDER_INSTANCE_HOST", self._runner_host(instance))
+            .with_env_variable("THUNDER_INSTANCE_PORT", str(instance.port))
+        )
+        if instance.private_key is not None:
+            # The key is generated per instance, and the hook needs it to log in
+            hook = hook.with_secret_variable("THUNDER_INSTANCE_SSH_KEY", instance.private_key)
+        try:
+            await (
+                hook
+                .with_env_variable("CACHEBUSTER", str(time()))
+                .with_exec(self.post_ready_hook_args)
+                .sync()
+            )
+        except dagger.ExecError as e:
+            raise PostReadyHookError(instance.instance_id, e.stderr.strip() or str(e))
+
+    async def _destroy_after_failure(self, token: str, instance_id: str) -> bool:
+        """Destroy an instance whose deploy failed, reporting rather than raising if that fails too
+
+        Returns whether the instance is gone, including when it was already.
+        """
+        try:
+            await self.destroy(instance_id, token=token)
+            print(f"{log_prefix()}Destroyed Thunder instance {instance_id} after its deploy failed")
+        except ThunderAPIError as e:
+            if e.status_code != 404:
+                print(f"{log_prefix()}Failed to destroy Thunder instance {instance_id} after its deploy failed: {e}")
+                return False
+        except Exception as e:
+            print(f"{log_prefix()}Failed to destroy Thunder instance {instance_id} after its deploy failed: {e}")
+            return False
+        return True
+
+    @function
+    def with_prefer_private_host(self, prefer: Annotated[bool, Doc("Whether to connect to instances on their private host")]) -> Self:
+        """Connect to instances on their private host rather than their public one, for pipelines running in the same network
+
+        This avoids egress costs and lowers latency. It applies to the SSH
+        setup script deploy returns, runner-service, the health probe, the post-ready
+        hook and drains. An instance with only one of the two hosts is reached
+        on that one either way.
+        """
+        self.prefer_private_host = prefer
+        return self
+
+    def _runner_host(self, instance: Instance) -> str:
+        """Host to connect to the instance on, honouring with-prefer-private-host"""
+        if self.prefer_private_host:
+            return instance.private_host or instance.host
+        return instance.public_host or instance.host
+
+    async def _runner_setup(self, instance: Instance, private_key: str) -> str:
+        """Wait for SSH on a running instance and return the shell commands that configure it as the Dagger runner"""
+        instance_id, host, port = instance.instance_id, self._runner_host(instance), instance.port
+
+        # Return both the environment variable and key information
+        thunder_dir = os.path.join("~", ".thunder")
+        keys_dir = os.path.join(thunder_dir, "keys")
+        key_path = os.path.join(keys_dir, f"{instance_id}")
+        
+        # Wait for SSH to be ready and get host key
+        host_key = await (
+            dag.container()
+            .from_("alpine:latest")
+            .with_exec(["apk", "add", "--no-cache", "openssh-client"])
+            .with_env_variable("CACHEBUSTER", str(time()))
+            .with_exec([
+                "sh", "-c",
+                # Retry ssh-keyscan with proper error handling and port
+                f'''for i in $(seq 1 10); do
+                    echo "Attempt $i: Scanning host {host} port {port}..."
+                    if KEY=$(ssh-keyscan -H -p {port} {host} 2>/dev/null); then
+                        echo "$KEY"
+                        exit 0
+                    fi
+                    sleep 3
+                done
+                echo "Failed to get host key after 10 attempts"
+                exit 1'''
+            ])
+            .stdout()
+        )
+        
+        # Create instructions for setting up the key
+        setup_instructions = [
+            f'mkdir -p {keys_dir}',
+            f'chmod 700 {thunder_dir} {keys_dir}',
+            f'cat > {key_path} << EOL\n{private_key}\nEOL',
+            f'chmod 600 {key_path}',
+            f'eval $(ssh-agent)',
+            f'ssh-add {key_path}',
+            'mkdir -p ~/.ssh',
+            'chmod 700 ~/.ssh',
+            # Add host key to known_hosts with port
+            f'cat > ~/.ssh/known_hosts.tmp << EOL\n[{host}]:{port} {host_key}\nEOL',
+            'cat ~/.ssh/known_hosts.tmp >> ~/.ssh/known_hosts',
+            'rm ~/.ssh/known_hosts.tmp',
+            'chmod 600 ~/.ssh/known_hosts',
+            # Add SSH config with port
+            f'''cat >> ~/.ssh/config << 'EOF'
 \nHost {host}
     User root
     Port {port}
     IdentityFile {key_path}
 
 EOF''',
-                        'chmod 600 ~/.ssh/config',
-                        f'''echo -e "export _EXPERIMENTAL_DAGGER_RUNNER_HOST="ssh://root@{host}:{port}""'''
-                    ]
-                    
-                    return "\n".join(setup_instructions)
+            'chmod 600 ~/.ssh/config',
+            f'''echo -e "export _EXPERIMENTAL_DAGGER_RUNNER_HOST="ssh://root@{host}:{port}""'''
+        ]
+        
+        return "\n".join(setup_instructions)
 
-                retry_count += 1
+    @function
+    def with_max_concurrent_api_requests(self, limit: Annotated[int, Doc("Maximum number of in-flight API requests")]) -> Self:
+        """Bound the number of Thunder API requests running at once across all operations"""
+        if limit < 1:
+            raise ValueError(f"Concurrency limit must be at least 1, got {limit}")
+        self.max_concurrent_api_requests = limit
+        return self
 
-            raise RuntimeError("Timed out waiting for Thunder instance to be ready")
+    @function
+    def with_name(self, name: Annotated[str, Doc("Name shown for instances in the Thunder dashboard")]) -> Self:
+        """Name deployed instances so they are identifiable in the Thunder dashboard
 
-        except Exception as e:
-            traceback.print_exc()
-            raise RuntimeError(f"Failed to deploy Thunder instance: {str(e)}")
+        Names are 1 to 63 lowercase letters, digits and '-', starting and ending
+        with a letter or digit.
+        """
+        if not INSTANCE_NAME_PATTERN.fullmatch(name):
+            raise ValueError(
+                f"Invalid instance name {name!r}: use 1 to 63 lowercase letters, digits and '-', "
+                "starting and ending with a letter or digit"
+            )
+        self.name = name
+        return self
 
     @function
-    async def status(self, token: Annotated[str, Doc("Thunder API token")]) -> str:
-        """List all active Thunder compute instances"""
-        if not token:
-            raise ValueError("Token is required")
+    def with_description(self, description: Annotated[str, Doc("Description shown for instances in the Thunder dashboard")]) -> Self:
+        """Describe deployed instances in the Thunder dashboard"""
+        description = description.strip()
+        if not description:
+            raise ValueError("Description is empty")
+        if len(description) > MAX_DESCRIPTION_LENGTH:
+            raise ValueError(f"Description is {len(description)} characters, the limit is {MAX_DESCRIPTION_LENGTH}")
+        if not description.isprintable():
+            raise ValueError("Description must be a single line of printable characters")
+        self.description = description
+        return self
 
-        try:
-            container = (
-                dag.container()
-                .from_("alpine:latest")
-                .with_exec(["apk", "add", "--no-cache", "curl"])
+    @function
+    def with_local_port(self, port: Annotated[int, Doc("Port runner services listen on")]) -> Self:
+        """Choose the port runner services expose, instead of the instance's SSH port"""
+        if not 1 <= port <= 65535:
+            raise ValueError(f"Port must be between 1 and 65535, got {port}")
+        self.local_port = port
+        return self
+
+    @function
+    def with_bulk_lookup_threshold(self, threshold: Annotated[int, Doc("Largest number of IDs fetched individually")]) -> Self:
+        """Choose when get-instances switches from per-ID requests to a single list request"""
+        if threshold < 0:
+            raise ValueError(f"Threshold must not be negative, got {threshold}")
+        self.bulk_lookup_threshold = threshold
+        return self
+
+    @function
+    def with_region(self, region: Annotated[str, Doc("Region to deploy instances in")]) -> Self:
+        """Deploy instances in a specific region instead of Thunder's default"""
+        if not region.strip():
+            raise ValueError("Region is empty")
+        self.region = region.strip()
+        return self
+
+    @function
+    def with_zone(self, zone: Annotated[str, Doc("Availability zone to deploy instances in, within the region")]) -> Self:
+        """Place instances in a specific availability zone, e.g. to colocate them with a volume
+
+        The zone must be in the region set with with-region, or in Thunder's
+        default region if none is set. It is only sent with deploys to that
+        region, so deploy-matrix deploys to other regions are placed by Thunder.
+        """
+        if not zone.strip():
+            raise ValueError("Zone is empty")
+        self.zone = zone.strip()
+        return self
+
+    @function
+    def with_default_labels(self, labels: Annotated[list[str], Doc("Labels to attach to every instance, as key=value")]) -> Self:
+        """Attach labels to every instance this module creates
+
+        Labels passed to a deploy call override defaults with the same key.
+        """
+        parse_labels(labels)
+        self.default_labels = list(labels)
+        return self
+
+    @function
+    def with_context_labels_from_env(
+        self,
+        env: Annotated[list[str], Doc("Environment variables of the CI run, as NAME=value")],
+        prefixes: Annotated[list[str], Doc("Environment variable name prefixes, e.g. GITHUB_ or CI_")],
+    ) -> Self:
+        """Label instances with the given environment variables matching the prefixes, to trace them back to a CI run
+
+        The module runs in its own container and can't see the caller's
+        environment, so the variables are passed in explicitly. Names and
+        values are sanitized into valid labels: GITHUB_RUN_ID=123 becomes
+        github-run-id=123. Variables whose value is empty after sanitizing are
+        skipped. Labels passed to a deploy call override these, and these
+        override default labels.
+        """
+        if not prefixes or not all(prefix.strip() for prefix in prefixes):
+            raise ValueError("Prefixes must be non-empty")
+        for entry in env:
+            name, sep, _ = entry.partition("=")
+            if not sep or not name.strip():
+                raise ValueError(f"Invalid environment variable {entry!r}: expected NAME=value")
+        self.context_env = list(env)
+        self.context_label_prefixes = list(prefixes)
+        return self
+
+    @function
+    def with_destroy_guard_label(
+        self,
+        key: Annotated[str, Doc("Label key instances must carry to be destroyed")],
+        value: Annotated[str, Doc("Label value instances must carry to be destroyed")],
+    ) -> Self:
+        """Only allow destroying instances labelled key=value
+
+        Instances deployed while the guard is set are given the label, so the
+        module can always destroy the runners it created itself.
+        """
+        if not key:
+            raise ValueError("Guard label key is required")
+        self.destroy_guard_key = key
+        self.destroy_guard_value = value
+        return self
+
+    @function
+    def with_event_webhook(self, url: Annotated[str, Doc("URL notified of instance lifecycle events")]) -> Self:
+        """Register a callback URL that Thunder notifies on instance lifecycle events
+
+        The webhook is sent with the create request. Deploy still polls for
+        readiness, so the webhook is for systems that want to react to events
+        asynchronously rather than a replacement for the wait.
+        """
+        parsed = urlparse(url.strip())
+        if parsed.scheme not in ("http", "https") or not parsed.netloc:
+            raise ValueError(f"Invalid webhook URL {url!r}: must be an absolute http or https URL")
+        self.event_webhook = url.strip()
+        return self
+
+    @function
+    async def with_user_data(
+        self,
+        script: Annotated[str, Doc("Boot script run when the instance starts")] = "",
+        file: Annotated[dagger.File | None, Doc("File containing the boot script, used instead of script")] = None,
+    ) -> Self:
+        """Customize the runner's boot with a cloud-init/user-data script
+
+        User data is sent in plaintext with the create request. Never embed
+        credentials in it: pass them to the runner as secrets instead.
+        """
+        if file is not None:
+            script = await file.contents()
+        if not script.strip():
+            raise ValueError("User data script is empty")
+        size = len(script.encode())
+        if size > MAX_USER_DATA_BYTES:
+            raise ValueError(f"User data is {size} bytes, the limit is {MAX_USER_DATA_BYTES}")
+        self.user_data = script
+        return self
+
+    @function
+    def with_idempotency_key(self, key: Annotated[str, Doc("Idempotency key sent with the create request")]) -> Self:
+        """Use a caller-supplied idempotency key instead of generating one per deploy
+
+        Functions that create several instances send it suffixed with the
+        instance's index, e.g. key-0 and key-1, so each create stays distinct.
+        """
+        if not key.strip():
+            raise ValueError("Idempotency key is empty")
+        self.idempotency_key = key.strip()
+        return self
+
+    @function
+    def with_volume(
+        self,
+        id: Annotated[str, Doc("ID of an existing Thunder volume")],
+        mount_path: Annotated[str, Doc("Absolute path to mount the volume at")],
+    ) -> Self:
+        """Attach a persistent volume, e.g. one holding the Dagger engine cache, to deployed instances
+
+        Call it once per volume to attach several.
+        """
+        if not id.strip():
+            raise ValueError("Volume ID is required")
+        if not mount_path.startswith("/") or ".." in mount_path.split("/"):
+            raise ValueError(f"Invalid mount path {mount_path!r}: must be absolute and must not contain '..'")
+        mount_path = posixpath.normpath(mount_path)
+        if mount_path == "/":
+            raise ValueError("Volumes can't be mounted at the root directory")
+        if any(v.mount_path == mount_path for v in self.volumes):
+            raise ValueError(f"A volume is already mounted at {mount_path}")
+        self.volumes.append(Volume(id=id.strip(), mount_path=mount_path))
+        return self
+
+    @function
+    def with_network(self, id: Annotated[str, Doc("ID of the private network to attach instances to")]) -> Self:
+        """Attach deployed instances to a private network, so runners reach private registries and caches without public egress
+
+        An instance on a private network may only be reachable from inside it,
+        in which case runner-service and the SSH setup script deploy returns only work
+        when the pipeline itself runs in that network.
+        """
+        id = id.strip()
+        if not NETWORK_ID_PATTERN.fullmatch(id):
+            raise ValueError(
+                f"Invalid network ID {id!r}: must be letters, digits, '-' and '_', "
+                "start with a letter or digit and be at most 128 characters"
             )
+        self.network_id = id
+        return self
 
-            # Get pods list
-            response = await (
-                container
+    @function
+    def with_drain(
+        self,
+        container: Annotated[dagger.Container, Doc("Container to run the drain command in")],
+        args: Annotated[list[str], Doc("Drain command to run")],
+    ) -> Self:
+        """Run a command before destroying an instance, e.g. to flush caches or let in-flight builds finish
+
+        The command runs in the container with THUNDER_INSTANCE_ID and
+        THUNDER_INSTANCE_HOST set. Without a drain, instances are deleted
+        immediately.
+        """
+        if not args:
+            raise ValueError("Drain command is required")
+        self.drain_container = container
+        self.drain_args = list(args)
+        return self
+
+    @function
+    def with_drain_failure_policy(self, policy: Annotated[str, Doc("abort or proceed")]) -> Self:
+        """Choose whether a failed drain aborts the destroy (the default) or is ignored"""
+        if policy not in (DRAIN_ABORT, DRAIN_PROCEED):
+            raise ValueError(f"Drain failure policy must be {DRAIN_ABORT} or {DRAIN_PROCEED}, got {policy!r}")
+        self.drain_failure_policy = policy
+        return self
+
+    async def _drain(self, instance_id: str, host: str) -> None:
+        """Run the drain command for an instance, applying the failure policy"""
+        try:
+            await (
+                self.drain_container
+                .with_env_variable("THUNDER_INSTANCE_ID", instance_id)
+                .with_env_variable("THUNDER_INSTANCE_HOST", host)
                 .with_env_variable("CACHEBUSTER", str(time()))
-                .with_exec([
-                    "sh", "-c",
-                    f"curl -s '{THUNDER_API_ENDPOINT}/pods' "
-                    f"-H 'Authorization: Bearer {token}'"
-                ])
-                .stdout()
+                .with_exec(self.drain_args)
+                .sync()
             )
+        except dagger.ExecError as e:
+            if self.drain_failure_policy == DRAIN_ABORT:
+                raise DrainError(instance_id, e.stderr.strip() or str(e))
+            print(f"{log_prefix()}Drain of Thunder instance {instance_id} failed, destroying it anyway: {e}")
+
+    def _is_protected(self, instance: Instance) -> bool:
+        """Whether the destroy guard forbids deleting the instance"""
+        if not self.destroy_guard_key:
+            return False
+        return not instance.has_label(self.destroy_guard_key, self.destroy_guard_value)
+
+    @function
+    async def status(self, token: TokenArg = "") -> str:
+        """List all active Thunder compute instances"""
+        token = await self._token(token)
+
+        try:
+            # Get pods list
+            status_code, response = await self._api_request(token, "GET", "/pods")
+            if status_code >= 400:
+                raise ThunderAPIError.from_response("list Thunder instances", status_code, response)
 
             # Parse the JSON response
-            response_data = json.loads(response)
+            response_data = parse_response(response, "list instances")
             pods_list = response_data.get('pods', [])
 
             if not pods_list:
                 return "No active Thunder instances found"
 
             result = "Active Thunder instances:\n"
-            for pod in pods_list:
-                result += f"\nInstance ID: {pod['instance_id']}"
-                result += f"\nStatus: {pod['status']}"
-                result += f"\nHost: {pod.get('host', 'Not available yet')}"
+            for pod in map(parse_instance, pods_list):
+                result += f"\nInstance ID: {pod.instance_id}"
+                result += f"\nStatus: {pod.status}"
+                result += f"\nHost: {pod.host or 'Not available yet'}"
                 result += "\n"
 
             return result
 
+        except (ThunderAPIError, InvalidResponseError):
+            raise
         except Exception as e:
             raise RuntimeError(f"Failed to list Thunder instances: {str(e)}")
 
+    @function
+    async def list_instances(
+        self,
+        name: Annotated[str, Doc("Only list instances with this name")] = "",
+        token: TokenArg = "",
+    ) -> list[Instance]:
+        """List all Thunder compute instances on the account"""
+        token = await self._token(token)
+
+        instances = await self._list_instances(token)
+        if name:
+            instances = [instance for instance in instances if instance.name == name]
+        return instances
+
+    @function
+    async def list_instances_filtered(
+        self,
+        filters: Annotated[list[str], Doc("Filters as key=value, e.g. status=running, type=a100, region=us-east, name=ci or label.team=ml")],
+        token: TokenArg = "",
+    ) -> list[Instance]:
+        """List the instances matching every filter
+
+        status, type and region are sent to the API as query parameters so it
+        can filter large accounts server-side. Every filter is also applied to
+        the listed instances, so the result is the same whether or not the API
+        honours them. name and label.<key> filters are only applied client-side.
+        """
+        token = await self._token(token)
+        parsed = parse_labels(filters)
+        for key in parsed:
+            if key not in SERVER_SIDE_FILTERS and key not in CLIENT_SIDE_FILTERS and not key.startswith("label."):
+                raise ValueError(
+                    f"Unknown instance filter {key!r}, expected one of "
+                    f"{', '.join([*SERVER_SIDE_FILTERS, *CLIENT_SIDE_FILTERS, 'label.<key>'])}"
+                )
+
+        query = {key: value for key, value in parsed.items() if key in SERVER_SIDE_FILTERS}
+        instances = await self._list_instances(token, query)
+
+        def matches(instance: Instance) -> bool:
+            for key, value in parsed.items():
+                if key.startswith("label."):
+                    if not instance.has_label(key.removeprefix("label."), value):
+                        return False
+                elif key == "status":
+                    if instance.status != normalize_status(value):
+                        return False
+                elif getattr(instance, SERVER_SIDE_FILTERS.get(key, key)) != value:
+                    return False
+            return True
+
+        return [instance for instance in instances if matches(instance)]
+
+    async def _list_instances(self, token: str, query: dict[str, str] | None = None) -> list[Instance]:
+        """List the instances on the account, passing the query parameters to the API"""
+        path = f"/pods?{urlencode(query)}" if query else "/pods"
+        status_code, body = await self._api_request(token, "GET", path)
+        if status_code >= 400:
+            raise ThunderAPIError.from_response("list Thunder instances", status_code, body)
+
+        return [parse_instance(pod) for pod in parse_response(body, "list instances").get('pods', [])]
+
+    @function
+    async def get_instance(
+        self,
+        instance_id: Annotated[str, Doc("Instance ID to get")],
+        token: TokenArg = "",
+    ) -> Instance:
+        """Get a single Thunder compute instance"""
+        token = await self._token(token)
+        if not instance_id:
+            raise ValueError("Instance ID is required")
+
+        instance = await self._find_instance(token, instance_id)
+        if instance is None:
+            raise ValueError(f"Thunder instance {instance_id} not found")
+        return instance
+
+    @function
+    async def get_instances(
+        self,
+        ids: Annotated[list[str], Doc("IDs of the instances to get")],
+        token: TokenArg = "",
+    ) -> list[Instance]:
+        """Get several instances at once, in the order of the IDs given
+
+        IDs that don't match an instance are left out. Up to the bulk lookup
+        threshold (see with-bulk-lookup-threshold) each instance is fetched on
+        its own, concurrently. Above it, the whole instance list is fetched once
+        and filtered, which is cheaper than many individual requests.
+        """
+        token = await self._token(token)
+        ids = list(dict.fromkeys(ids))
+
+        if len(ids) > self.bulk_lookup_threshold:
+            by_id = {instance.instance_id: instance for instance in await self.list_instances(token=token)}
+            found = [by_id.get(instance_id) for instance_id in ids]
+        else:
+            found = await asyncio.gather(*(self._find_instance(token, instance_id) for instance_id in ids))
+
+        return [instance for instance in found if instance is not None]
+
+    async def _find_instance(self, token: str, instance_id: str) -> Instance | None:
+        """Get an instance, or None if it doesn't exist"""
+        status_code, body = await self._api_request(token, "GET", f"/pods/{instance_id}")
+        if status_code == 404:
+            return None
+        if status_code >= 400:
+            raise ThunderAPIError.from_response("get Thunder instance", status_code, body)
+        return parse_instance(parse_response(body, "get instance"))
+
+    @function
+    async def list_stale_instances(
+        self,
+        older_than: Annotated[int, Doc("Minimum instance age, in seconds")],
+        token: TokenArg = "",
+    ) -> list[Instance]:
+        """List instances created more than older_than seconds ago
+
+        Instances whose creation time is unknown are skipped, so they are never
+        reported as stale. Ages are approximate because they depend on the
+        server and local clocks agreeing.
+        """
+        if older_than < 0:
+            raise ValueError(f"Age must not be negative, got {older_than}")
+
+        return [
+            instance for instance in await self.list_instances(token=token)
+            if instance.created_at_time() is not None and instance.age_seconds() > older_than
+        ]
+
+    @function
+    async def list_instance_types(self, token: TokenArg = "") -> list[InstanceType]:
+        """List the compute configurations Thunder offers
+
+        The name of each type is a valid gpu-type for deploy. The hourly price is
+        zero when Thunder doesn't publish one.
+        """
+        token = await self._token(token)
+
+        catalog = await self._get_optional(
+            token, "/instance-types", "listing instance types", "list instance types", cache=True,
+        )
+        return [parse_instance_type(entry) for entry in catalog.get('instance_types', [])]
+
+    async def _check_gpu_type(self, token: str, gpu_type: str) -> None:
+        """Raise ValueError unless the GPU type is a built-in one or listed in Thunder's instance type catalog"""
+        if gpu_type in GPU_TYPES:
+            return
+        try:
+            catalog = await self.list_instance_types(token=token)
+        except UnsupportedEndpointError:
+            catalog = []
+        known = [*GPU_TYPES, *(t.name for t in catalog if t.name not in GPU_TYPES)]
+        if gpu_type not in known:
+            raise ValueError(f"Unknown GPU type {gpu_type!r}, expected one of: {', '.join(known)}")
+
+    @function
+    def with_hourly_rate(
+        self,
+        gpu_type: Annotated[str, Doc("GPU type the rate applies to")],
+        usd: Annotated[float, Doc("Hourly cost of an instance of that type, in US dollars")],
+    ) -> Self:
+        """Price instances of a GPU type at this hourly rate, e.g. a negotiated one, instead of Thunder's published price"""
+        if not gpu_type.strip():
+            raise ValueError("GPU type is required")
+        if usd < 0:
+            raise ValueError(f"Hourly rate must not be negative, got {usd}")
+        gpu_type = gpu_type.strip()
+        rates = [rate for rate in self.hourly_rates if rate.partition("=")[0] != gpu_type]
+        self.hourly_rates = [*rates, f"{gpu_type}={usd}"]
+        return self
+
+    async def _price_instance(self, token: str, instance: Instance) -> None:
+        """Fill in the hourly cost of a deployed instance when its price is known
+
+        Rates set with with-hourly-rate win over the instance type catalog. A
+        catalog that can't be fetched or has no price for the type leaves the
+        cost unknown rather than failing the deploy.
+        """
+        rates = {key: float(value) for key, value in parse_labels(self.hourly_rates).items()}
+        if instance.gpu_type in rates:
+            instance.hourly_cost_usd, instance.cost_known = rates[instance.gpu_type], True
+            return
+        try:
+            catalog = await self.list_instance_types(token=token)
+        except Exception as e:
+            # Pricing is informational, so no failure to fetch the catalog, including the curl exec, fails a deploy
+            print(f"{log_prefix()}Cost of Thunder instance {instance.instance_id} is unknown: {e}")
+            return
+        for instance_type in catalog:
+            if instance_type.name == instance.gpu_type and instance_type.hourly_price > 0:
+                instance.hourly_cost_usd, instance.cost_known = instance_type.hourly_price, True
+                return
+
+    @function
+    async def list_regions(self, token: TokenArg = "") -> list[Region]:
+        """List the regions Thunder can deploy instances in, e.g. to pick one for with-region
+
+        A region is reported available unless Thunder says it is out of
+        capacity.
+        """
+        token = await self._token(token)
+
+        data = await self._get_optional(token, "/regions", "listing regions", "list regions", cache=True)
+        return [parse_region(entry) for entry in data.get('regions', [])]
+
+    @function
+    async def test_connection(self, token: TokenArg = "") -> Diagnostics:
+        """Check connectivity to the Thunder API step by step: DNS resolution, TLS handshake and an authenticated request
+
+        Checks stop at the first failure, and the steps that ran are reported
+        either way. Nothing is created, and the token never appears in the
+        results. The token is only resolved for the API step, so a missing
+        token fails that step while the DNS and TLS results are still returned.
+        """
+        parsed = urlparse(self.api_endpoint)
+        host = parsed.hostname or ""
+        port = parsed.port or (443 if parsed.scheme == "https" else 80)
+        diagnostics = Diagnostics(endpoint=self.api_endpoint)
+
+        async def run(name, check) -> bool:
+            started = monotonic()
+            try:
+                detail = await asyncio.wait_for(check(), timeout=self.request_timeout)
+                passed = True
+            except Exception as e:
+                detail = f"{type(e).__name__}: {e}"
+                passed = False
+            diagnostics.steps.append(DiagnosticStep(
+                name=name,
+                passed=passed,
+                duration_seconds=monotonic() - started,
+                detail=str(detail).replace(token, "[redacted]") if token.strip() else str(detail),
+            ))
+            return passed
+
+        async def resolve():
+            addresses = await asyncio.get_running_loop().getaddrinfo(host, port)
+            return ", ".join(sorted({address[4][0] for address in addresses}))
+
+        async def handshake():
+            if parsed.scheme != "https":
+                return "skipped, endpoint doesn't use TLS"
+            _, writer = await asyncio.open_connection(host, port, ssl=True, server_hostname=host)
+            version = writer.get_extra_info("ssl_object").version()
+            writer.close()
+            await writer.wait_closed()
+            return version
+
+        async def ping():
+            nonlocal token
+            token = await self._token(token)
+            status_code, body = await self._api_request(token, "GET", "/pods")
+            if status_code >= 400:
+                raise ThunderAPIError.from_response("list Thunder instances", status_code, body)
+            return f"HTTP {status_code}"
+
+        for name, check in (("dns", resolve), ("tls", handshake), ("api", ping)):
+            if not await run(name, check):
+                break
+
+        return diagnostics
+
+    @function
+    async def account_quota(self, token: TokenArg = "") -> Quota:
+        """Get the account's instance limits and current usage"""
+        token = await self._token(token)
+
+        quota_data = await self._get_optional(token, "/quota", "account quotas", "get account quota", cache=True)
+        return parse_quota(quota_data)
+
+    @function
+    async def instance_metrics(
+        self,
+        instance_id: Annotated[str, Doc("Instance ID to get metrics for")],
+        token: TokenArg = "",
+    ) -> InstanceMetrics:
+        """Get the current GPU, CPU and memory utilization of an instance, e.g. to tell whether it is idle"""
+        token = await self._token(token)
+        if not instance_id:
+            raise ValueError("Instance ID is required")
+
+        metrics = await self._get_optional(
+            token, f"/pods/{instance_id}/metrics", "instance metrics", "get instance metrics",
+        )
+        return parse_instance_metrics(metrics)
+
     @function
     async def destroy(
         self,
-        token: Annotated[str, Doc("Thunder API token")],
-        instance_id: Annotated[str, Doc("Instance ID to destroy")]
+        instance_id: Annotated[str, Doc("Instance ID to destroy")],
+        token: TokenArg = "",
     ) -> str:
         """Destroy a Thunder compute instance and clean up associated SSH keys and config"""
-        if not token:
-            raise ValueError("Token is required")
+        token = await self._token(token)
         if not instance_id:
             raise ValueError("Instance ID is required")
 
-        try:
-            container = (
-                dag.container()
-                .from_("alpine:latest")
-                .with_exec(["apk", "add", "--no-cache", "curl"])
-            )
+        with self._operation():
+            return await self._destroy(token, instance_id)
 
+    async def _destroy(self, token: str, instance_id: str) -> str:
+        try:
             # First get the host information before destroying
-            status_response = await (
-                container
-                .with_env_variable("CACHEBUSTER", str(time()))
-                .with_exec([
-                    "sh", "-c",
-                    f"curl -s '{THUNDER_API_ENDPOINT}/pods/{instance_id}' "
-                    f"-H 'Authorization: Bearer {token}'"
-                ])
-                .stdout()
-            )
+            status_code, status_response = await self._api_request(token, "GET", f"/pods/{instance_id}")
+            if status_code >= 400:
+                raise ThunderAPIError.from_response("destroy Thunder instance", status_code, status_response)
 
             # Parse the response to get host info for cleanup
-            status_data = json.loads(status_response)
-            host = status_data.get('host', '')
-            if host:
-                host = host
+            instance = parse_instance(parse_response(status_response, "status"))
+            host = self._runner_host(instance)
+
+            if self._is_protected(instance):
+                raise DestroyGuardError(instance_id, self.destroy_guard_key, self.destroy_guard_value)
+
+            if self.drain_container is not None:
+                await self._drain(instance_id, host)
 
             # Destroy the instance
-            await (
-                container
-                .with_env_variable("CACHEBUSTER", str(time()))
-                .with_exec([
-                    "sh", "-c",
-                    f"curl -s -X DELETE '{THUNDER_API_ENDPOINT}/pods/{instance_id}' "
-                    f"-H 'Authorization: Bearer {token}'"
-                ])
-                .sync()
-            )
+            status_code, response = await self._api_request(token, "DELETE", f"/pods/{instance_id}")
+            if status_code >= 400:
+                raise ThunderAPIError.from_response("destroy Thunder instance", status_code, response)
 
             # Create cleanup instructions
             thunder_dir = os.path.join("~", ".thunder")
             keys_dir = os.path.join(thunder_dir, "keys")
             key_path = os.path.join(keys_dir, f"{instance_id}")
             
-            cleanup_instructions = [
-                f'rm -f {key_path}',
+            cleanup_instructions = [f'rm -f {key_path}']
+            if not host:
+                # Without a host, the config cleanup below would match every Host entry
+                return "\n".join(cleanup_instructions)
+
+            cleanup_instructions += [
                 # Remove host from known_hosts if it exists
                 f'ssh-keygen -R {host} 2>/dev/null || true',
                 # Remove SSH config entry if it exists
@@ -261,5 +2200,239 @@ EOF''',
 
             return "\n".join(cleanup_instructions)
 
+        except (DestroyGuardError, DrainError, ThunderAPIError, InvalidResponseError):
+            raise
         except Exception as e:
-            raise RuntimeError(f"Failed to destroy Thunder instance: {str(e)}")
\ No newline at end of file
+            raise RuntimeError(f"Failed to destroy Thunder instance (request ID {current_request_id()}): {str(e)}")
+
+    @function
+    async def destroy_all(self, token: TokenArg = "") -> DestroyReport:
+        """Destroy every instance on the account, skipping those protected by the destroy guard label"""
+        report = DestroyReport()
+        cleanup_instructions = []
+        for instance in await self.list_instances(token=token):
+            if self._is_protected(instance):
+                report.skipped.append(instance.instance_id)
+                continue
+            cleanup_instructions.append(await self.destroy(instance.instance_id, token=token))
+            report.destroyed.append(instance.instance_id)
+
+        report.cleanup_instructions = "\n".join(cleanup_instructions)
+        return report
+
+    @function
+    def build_create_body(
+        self,
+        gpu_type: Annotated[str, Doc("GPU type")] = "t4",
+        labels: Annotated[list[str] | None, Doc("Labels to attach, as key=value")] = None,
+    ) -> str:
+        """Return the JSON body a deploy with these arguments would send, without sending anything
+
+        Useful to check how default labels, environment labels, per-call labels
+        and the other options combine before paying for an instance. The GPU
+        type is part of the request path rather than the body. An empty string
+        means the create request is sent without a body.
+        """
+        return self._encode_create_body(DeployOptions(gpu_type, parse_labels(labels))) or ""
+
+    async def _get_optional(
+        self,
+        token: str,
+        path: str,
+        feature: str,
+        operation: str,
+        cache: bool = False,
+    ) -> dict[str, Any]:
+        """GET an endpoint Thunder may not implement, raising UnsupportedEndpointError if it doesn't"""
+        status_code, body = await self._api_request(token, "GET", path, cache=cache)
+        if status_code in UNSUPPORTED_STATUS_CODES:
+            raise UnsupportedEndpointError(feature, status_code)
+        if status_code >= 400:
+            raise ThunderAPIError.from_response(operation, status_code, body)
+        return parse_response(body, operation)
+
+    async def _create_pod(self, token: str, options: DeployOptions, count: int = 1) -> tuple[int, str]:
+        """Send the create request for count instances, retrying transient failures under a single idempotency key
+
+        The attempts share the create timeout: each one gets what is left of
+        it, and no retry starts once it has run out.
+        """
+        await self._check_gpu_type(token, options.gpu_type)
+        create_body = self._encode_create_body(options)
+        # The same key is sent on every attempt so Thunder can recognise a retried
+        # create and avoid provisioning a second instance
+        key = self.idempotency_key
+        if key and options.idempotency_suffix:
+            key = f"{key}-{options.idempotency_suffix}"
+        headers = {"Idempotency-Key": key or str(uuid.uuid4())}
+        deadline = monotonic() + self.create_timeout
+
+        def send():
+            return self._api_request(
+                token, "POST", f"/pods/{options.gpu_type}/{count}",
+                body=create_body,
+                timeout=max(1, int(deadline - monotonic())),
+                headers=headers,
+            )
+
+        for attempt in range(1, CREATE_ATTEMPTS):
+            try:
+                status_code, response = await send()
+                # No retry once it couldn't start before the create timeout runs out
+                if status_code < 500 or monotonic() + CREATE_RETRY_DELAY >= deadline:
+                    return status_code, response
+                print(f"{log_prefix()}Create attempt {attempt}/{CREATE_ATTEMPTS} failed with HTTP {status_code}")
+            except dagger.ExecError as e:
+                # curl failed before getting a response, e.g. a dropped connection or the timeout
+                if monotonic() + CREATE_RETRY_DELAY >= deadline:
+                    raise
+                print(f"{log_prefix()}Create attempt {attempt}/{CREATE_ATTEMPTS} failed: {e.stderr.strip() or e}")
+            await asyncio.sleep(CREATE_RETRY_DELAY)
+
+        return await send()
+
+    def _encode_create_body(self, options: DeployOptions) -> str | None:
+        """Serialize the create request body, or return None if there is nothing to send"""
+        body = self._create_body(options)
+        return json.dumps(body, sort_keys=True) if body else None
+
+    def _create_body(self, options: DeployOptions) -> dict[str, Any]:
+        """Build the JSON body sent with the create request from the configured options"""
+        body: dict[str, Any] = {}
+        # Per-call labels take precedence over labels taken from the environment,
+        # which take precedence over the module's default labels
+        merged_labels = {
+            **parse_labels(self.default_labels),
+            **labels_from_env(self.context_label_prefixes, self._context_environ()),
+            **options.labels,
+        }
+        if self.destroy_guard_key:
+            # Instances the module creates carry the guard label, so its own
+            # cleanup of runners it deployed isn't blocked by the guard
+            merged_labels[self.destroy_guard_key] = self.destroy_guard_value
+        if merged_labels:
+            body['labels'] = merged_labels
+        region, zone = self._placement(options)
+        if region:
+            body['region'] = region
+        if zone:
+            body['zone'] = zone
+        if self.network_id:
+            body['network_id'] = self.network_id
+        if self.name:
+            body['name'] = self.name
+        if self.description:
+            body['description'] = self.description
+        if self.event_webhook:
+            body['webhook_url'] = self.event_webhook
+        if self.user_data:
+            body['user_data'] = self.user_data
+        volumes = self.volumes if options.volumes is None else options.volumes
+        if volumes:
+            body['volumes'] = [{'id': v.id, 'mount_path': v.mount_path} for v in volumes]
+        return body
+
+    def _context_environ(self) -> dict[str, str]:
+        """Environment variables passed to with-context-labels-from-env, by name"""
+        environ = {}
+        for entry in self.context_env:
+            name, _, value = entry.partition("=")
+            environ[name.strip()] = value
+        return environ
+
+    def _placement(self, options: DeployOptions) -> tuple[str, str]:
+        """Region and zone a deploy asks for, empty when left to Thunder"""
+        region = options.region or self.region
+        if options.zone:
+            return region, options.zone
+        # The module's zone belongs to the module's region
+        return region, self.zone if region == self.region else ""
+
+    async def _api_request(
+        self,
+        token: str,
+        method: str,
+        path: str,
+        body: str | None = None,
+        timeout: int | None = None,
+        headers: dict[str, str] | None = None,
+        cache: bool = False,
+    ) -> tuple[int, str]:
+        """Send a request to the Thunder API and return the HTTP status code with the response body
+
+        With cache set, the ETag of a successful response is remembered in a
+        cache volume and the next identical request, in this call or a later
+        one, asks the API to answer 304 if nothing changed, in which case the
+        remembered body is returned with a 200.
+        """
+        if token in _provided_tokens:
+            token = await self._provide_token()
+
+        status_code, response = await self._send_api_request(token, method, path, body, timeout, headers, cache)
+        if status_code == 401 and token in _provided_tokens:
+            # The token may have rotated between fetching and sending, so try once more with a fresh one.
+            # An explicit token is sent as given, a new one from the provider wouldn't be the caller's.
+            token = await self._provide_token()
+            status_code, response = await self._send_api_request(
+                token, method, path, body, timeout, headers, cache,
+            )
+        return status_code, response
+
+    async def _send_api_request(
+        self,
+        token: str,
+        method: str,
+        path: str,
+        body: str | None,
+        timeout: int | None,
+        headers: dict[str, str] | None,
+        cache: bool = False,
+    ) -> tuple[int, str]:
+        """Run a single curl request against the Thunder API, returning the status code and body"""
+        url = f"{self.api_endpoint}{path}"
+        container = (
+            dag.container()
+            .from_("alpine:latest")
+            .with_exec(["apk", "add", "--no-cache", "curl"])
+            .with_env_variable("CACHEBUSTER", str(time()))
+            # The token reaches curl as a secret so it never shows up in the exec's arguments or traces
+            .with_secret_variable("THUNDER_TOKEN", token_secret(token))
+        )
+        if cache:
+            # Entries are separate for every URL and token, named by a hash so the token isn't written out
+            entry = hashlib.sha256(f"{url}\n{token}".encode()).hexdigest()
+            container = (
+                container
+                .with_mounted_cache(ETAG_CACHE_DIR, dag.cache_volume(ETAG_CACHE_VOLUME))
+                .with_env_variable("THUNDER_CACHE_ENTRY", entry)
+                .with_env_variable("THUNDER_CACHE_SIZE", str(ETAG_CACHE_SIZE))
+            )
+        args = [
+            "sh", "-c", CURL_SCRIPT, "curl",
+            "-s", "--max-time", str(timeout or self.request_timeout), "-X", method, url,
+            # Ask for JSON explicitly so errors don't come back as HTML pages
+            "-H", "Accept: application/json",
+            "-H", f"User-Agent: {USER_AGENT}",
+            "-H", f"X-Client-Version: {MODULE_VERSION}",
+        ]
+        request_id = current_request_id()
+        if request_id:
+            args += ["-H", f"X-Request-ID: {request_id}"]
+        for name, value in (headers or {}).items():
+            args += ["-H", f"{name}: {value}"]
+        if body is not None:
+            # Pass the body through a file so it needs no shell quoting
+            container = container.with_new_file("/tmp/body.json", body)
+            args += ["-H", "Content-Type: application/json", "--data-binary", "@/tmp/body.json"]
+
+        if self.log_requests:
+            print(f"{log_prefix()}--> {method} {path}" + (f" {log_body(body, self.max_body_log_bytes)}" if body is not None else ""))
+
+        async with api_semaphore(self.max_concurrent_api_requests):
+            output = await container.with_exec(args).stdout()
+
+        # The script appends the status code on its own line after the body
+        response, _, status_code = output.rpartition("\n")
+        if self.log_requests:
+            print(f"{log_prefix()}<-- {status_code} {method} {path} {log_body(response, self.max_body_log_bytes)}")
+        return int(status_code), response
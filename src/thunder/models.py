@@ -0,0 +1,361 @@
+"""Typed views of Thunder API responses
+
+Every response the module decodes is described here. Decoding is lenient:
+fields the module doesn't know are ignored, so additions to the API don't
+break it. Strict decoding, for tests that should catch unexpected response
+shapes, raises InvalidResponseError on unknown fields instead. Turn it on with
+set_strict_decoding or by setting THUNDER_STRICT_DECODING=1.
+"""
+from datetime import datetime, timezone
+from typing import Any, Iterable
+import json
+import os
+
+import dagger
+
+from .errors import InvalidResponseError
+
+_strict_decoding = os.environ.get("THUNDER_STRICT_DECODING") == "1"
+
+
+def set_strict_decoding(enabled: bool) -> None:
+    """Choose whether decoding a response with fields the module doesn't know fails"""
+    global _strict_decoding
+    _strict_decoding = enabled
+
+
+def check_fields(data: dict[str, Any], known: Iterable[str], source: str) -> None:
+    """Raise InvalidResponseError for fields outside known when decoding strictly"""
+    if not _strict_decoding:
+        return
+    unknown = sorted(set(data) - set(known))
+    if unknown:
+        raise InvalidResponseError(source, f"unknown fields {', '.join(unknown)}", json.dumps(data))
+
+
+def parse_response(raw_response: str, source: str) -> dict[str, Any]:
+    """Decode a JSON object returned by the API, raising InvalidResponseError if it isn't one"""
+    try:
+        data = json.loads(raw_response)
+    except json.JSONDecodeError as e:
+        raise InvalidResponseError(source, f"malformed JSON ({e})", raw_response)
+    if not isinstance(data, dict):
+        raise InvalidResponseError(source, "expected a JSON object", raw_response)
+    return data
+
+
+def require_field(data: dict[str, Any], name: str, raw_response: str, source: str) -> str:
+    """Return a trimmed field from a decoded response, raising InvalidResponseError if it is missing or empty"""
+    value = clean(data.get(name))
+    if not value:
+        raise InvalidResponseError(source, f"missing {name}", raw_response)
+    return value
+
+
+def clean(value: Any) -> str:
+    """Trim surrounding whitespace from a string field returned by the API"""
+    return "" if value is None else str(value).strip()
+
+
+def normalize_status(value: Any) -> str:
+    """Normalize an instance status so comparisons ignore casing and padding"""
+    return clean(value).lower()
+
+
+@dagger.object_type
+class Quota:
+    """Instance limits and current usage for a Thunder account"""
+
+    max_pods: int = dagger.field(default=0)
+    used_pods: int = dagger.field(default=0)
+    gpu_quota: int = dagger.field(default=0)
+
+    @dagger.function
+    def available_pods(self) -> int:
+        """Number of instances that can still be created before hitting the limit"""
+        return max(self.max_pods - self.used_pods, 0)
+
+
+QUOTA_FIELDS = ("max_pods", "used_pods", "gpu_quota")
+
+
+def parse_quota(data: dict[str, Any]) -> Quota:
+    """Build a Quota from a Thunder quota response"""
+    check_fields(data, QUOTA_FIELDS, "quota")
+    return Quota(
+        max_pods=int(data.get('max_pods') or 0),
+        used_pods=int(data.get('used_pods') or 0),
+        gpu_quota=int(data.get('gpu_quota') or 0),
+    )
+
+
+@dagger.object_type
+class Label:
+    """A key/value label attached to a Thunder instance"""
+
+    key: str = dagger.field(default="")
+    value: str = dagger.field(default="")
+
+
+@dagger.object_type
+class Volume:
+    """A persistent volume attached to a Thunder instance"""
+
+    id: str = dagger.field(default="")
+    mount_path: str = dagger.field(default="")
+
+
+@dagger.object_type
+class Instance:
+    """A Thunder compute instance"""
+
+    instance_id: str = dagger.field(default="")
+    name: str = dagger.field(default="")
+    description: str = dagger.field(default="")
+    status: str = dagger.field(default="")
+    gpu_type: str = dagger.field(default="")
+    region: str = dagger.field(default="")
+    zone: str = dagger.field(default="")
+    network_id: str = dagger.field(default="")
+    host: str = dagger.field(default="")
+    public_host: str = dagger.field(default="")
+    private_host: str = dagger.field(default="")
+    port: int = dagger.field(default=0)
+    created_at: str = dagger.field(default="")
+    hourly_cost_usd: float = dagger.field(default=0.0)
+    cost_known: bool = dagger.field(default=False)
+    labels: list[Label] = dagger.field(default=list)
+    volumes: list[Volume] = dagger.field(default=list)
+    private_key: dagger.Secret | None = dagger.field(default=None)
+
+    @dagger.function
+    def label(self, key: str) -> str:
+        """Value of the label with the given key, or an empty string if it isn't set"""
+        for label in self.labels:
+            if label.key == key:
+                return label.value
+        return ""
+
+    def has_label(self, key: str, value: str) -> bool:
+        """Whether the instance carries the label key=value"""
+        return any(label.key == key and label.value == value for label in self.labels)
+
+    def created_at_time(self) -> datetime | None:
+        """Creation time as an aware datetime, or None if the API didn't report a parseable one"""
+        return parse_timestamp(self.created_at)
+
+    @dagger.function
+    def age_seconds(self) -> float:
+        """Seconds since the instance was created, or zero if unknown
+
+        Ages are approximate: they compare the server's clock with the local
+        one, and a creation time in the future because of clock skew counts as
+        zero rather than a negative age.
+        """
+        created = self.created_at_time()
+        if created is None:
+            return 0.0
+        return max((datetime.now(timezone.utc) - created).total_seconds(), 0.0)
+
+
+def parse_timestamp(value: str) -> datetime | None:
+    """Parse an RFC 3339 or Unix seconds timestamp into an aware datetime, or None if it is neither"""
+    if not value:
+        return None
+    try:
+        return datetime.fromtimestamp(float(value), tz=timezone.utc)
+    except (ValueError, OverflowError, OSError):
+        pass
+    try:
+        parsed = datetime.fromisoformat(value.replace("Z", "+00:00"))
+    except ValueError:
+        return None
+    if parsed.tzinfo is None:
+        parsed = parsed.replace(tzinfo=timezone.utc)
+    return parsed
+
+
+# The create response also carries the new instance's SSH private key
+INSTANCE_FIELDS = (
+    "instance_id", "name", "description", "status", "gpu_type", "region", "zone", "network_id",
+    "host", "public_host", "private_host", "port", "created_at", "labels", "volumes", "private_key",
+)
+VOLUME_FIELDS = ("id", "mount_path")
+
+
+def parse_instance(pod: dict[str, Any]) -> Instance:
+    """Build an Instance from a pod object returned by the Thunder API
+
+    host is the API's own host field, falling back to the public and then the
+    private host. The public host falls back to host, since that is the
+    address Thunder gives when it reports only one.
+    """
+    check_fields(pod, INSTANCE_FIELDS, "instance")
+    for volume in pod.get('volumes') or []:
+        check_fields(volume, VOLUME_FIELDS, "instance volume")
+    host = clean(pod.get('host'))
+    public_host = clean(pod.get('public_host')) or host
+    private_host = clean(pod.get('private_host'))
+    return Instance(
+        instance_id=clean(pod.get('instance_id')),
+        name=clean(pod.get('name')),
+        description=clean(pod.get('description')),
+        status=normalize_status(pod.get('status')),
+        gpu_type=clean(pod.get('gpu_type')),
+        region=clean(pod.get('region')),
+        zone=clean(pod.get('zone')),
+        network_id=clean(pod.get('network_id')),
+        host=host or public_host or private_host,
+        public_host=public_host,
+        private_host=private_host,
+        port=int(clean(pod.get('port')) or 0),
+        created_at=clean(pod.get('created_at')),
+        labels=[Label(key=clean(k), value=clean(v)) for k, v in (pod.get('labels') or {}).items()],
+        volumes=[
+            Volume(id=clean(v.get('id')), mount_path=clean(v.get('mount_path')))
+            for v in pod.get('volumes') or []
+        ],
+    )
+
+
+@dagger.object_type
+class Deployment:
+    """A deployed Dagger runner, with the shell commands that make it the local Dagger runner"""
+
+    instance: Instance = dagger.field(default=Instance)
+    setup_script: str = dagger.field(default="")
+    # Host the setup script connects to, which honours with-prefer-private-host
+    runner_host: str = ""
+
+    @dagger.function
+    def instance_id(self) -> str:
+        """ID of the runner's instance, for destroy"""
+        return self.instance.instance_id
+
+    @dagger.function
+    def host(self) -> str:
+        """Host the runner is reached on, the same one the setup script connects to"""
+        return self.runner_host or self.instance.host
+
+    @dagger.function
+    def port(self) -> int:
+        """SSH port of the runner"""
+        return self.instance.port
+
+    @dagger.function
+    def status(self) -> str:
+        """Status of the runner's instance when the deploy returned"""
+        return self.instance.status
+
+
+@dagger.object_type
+class DestroyReport:
+    """Outcome of destroying several instances at once"""
+
+    destroyed: list[str] = dagger.field(default=list)
+    skipped: list[str] = dagger.field(default=list)
+    cleanup_instructions: str = dagger.field(default="")
+
+
+@dagger.object_type
+class InstanceType:
+    """A compute configuration Thunder can provision"""
+
+    name: str = dagger.field(default="")
+    gpu: str = dagger.field(default="")
+    vcpus: int = dagger.field(default=0)
+    memory_gb: int = dagger.field(default=0)
+    hourly_price: float = dagger.field(default=0.0)
+
+
+INSTANCE_TYPE_FIELDS = ("name", "gpu", "vcpus", "memory_gb", "hourly_price")
+
+
+def parse_instance_type(data: dict[str, Any]) -> InstanceType:
+    """Build an InstanceType from an entry of the Thunder instance type catalog"""
+    check_fields(data, INSTANCE_TYPE_FIELDS, "instance type")
+    return InstanceType(
+        name=clean(data.get('name')),
+        gpu=clean(data.get('gpu')),
+        vcpus=int(data.get('vcpus') or 0),
+        memory_gb=int(data.get('memory_gb') or 0),
+        hourly_price=float(data.get('hourly_price') or 0.0),
+    )
+
+
+@dagger.object_type
+class Region:
+    """A region Thunder can deploy instances in"""
+
+    name: str = dagger.field(default="")
+    available: bool = dagger.field(default=True)
+
+
+REGION_FIELDS = ("name", "available")
+
+
+def parse_region(data: Any) -> Region:
+    """Build a Region from an entry of the Thunder region list, which may be just its name
+
+    A region is taken to be available unless the API says otherwise.
+    """
+    if not isinstance(data, dict):
+        return Region(name=clean(data))
+    check_fields(data, REGION_FIELDS, "region")
+    available = data.get('available')
+    return Region(name=clean(data.get('name')), available=True if available is None else bool(available))
+
+
+@dagger.object_type
+class InstanceMetrics:
+    """Resource utilization of a running Thunder instance"""
+
+    gpu_percent: float = dagger.field(default=0.0)
+    cpu_percent: float = dagger.field(default=0.0)
+    memory_bytes: int = dagger.field(default=0)
+
+
+INSTANCE_METRICS_FIELDS = ("gpu_percent", "cpu_percent", "memory_bytes")
+
+
+def parse_instance_metrics(data: dict[str, Any]) -> InstanceMetrics:
+    """Build InstanceMetrics from a Thunder metrics response"""
+    check_fields(data, INSTANCE_METRICS_FIELDS, "instance metrics")
+    return InstanceMetrics(
+        gpu_percent=float(data.get('gpu_percent') or 0.0),
+        cpu_percent=float(data.get('cpu_percent') or 0.0),
+        memory_bytes=int(data.get('memory_bytes') or 0),
+    )
+
+
+@dagger.object_type
+class MatrixResult:
+    """An instance deployed as part of a deploy matrix"""
+
+    instance_type: str = dagger.field(default="")
+    region: str = dagger.field(default="")
+    provision_seconds: float = dagger.field(default=0.0)
+    instance: Instance = dagger.field(default=Instance)
+
+
+@dagger.object_type
+class DiagnosticStep:
+    """Outcome of one connectivity check"""
+
+    name: str = dagger.field(default="")
+    passed: bool = dagger.field(default=False)
+    duration_seconds: float = dagger.field(default=0.0)
+    detail: str = dagger.field(default="")
+
+
+@dagger.object_type
+class Diagnostics:
+    """Results of the connectivity checks run by test-connection"""
+
+    endpoint: str = dagger.field(default="")
+    steps: list[DiagnosticStep] = dagger.field(default=list)
+
+    @dagger.function
+    def passed(self) -> bool:
+        """Whether every check that ran passed"""
+        return bool(self.steps) and all(step.passed for step in self.steps)
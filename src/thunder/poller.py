@@ -0,0 +1,60 @@
+"""Polling shared by every wait in the Thunder module"""
+import asyncio
+from time import monotonic
+from typing import Awaitable, Callable
+
+from .errors import PollTimeoutError
+
+
+class Poller:
+    """Calls a check until it reports done, sleeping between attempts, for at most a timeout
+
+    This is the polling behind every wait in the module, and is part of its
+    public Python API for flows built on the lower-level functions::
+
+        async def running() -> bool:
+            return (await thunder.get_instance(instance_id)).status == "running"
+
+        await Poller(timeout=300).wait(running)
+
+    The sleep starts at interval and is multiplied by backoff after every
+    attempt, up to max_interval. A backoff of 1 polls at a fixed interval.
+    Polling stops with PollTimeoutError as soon as the next sleep would end
+    past the timeout, rather than sleeping through it. Errors raised by the
+    check are not retried: they end the wait.
+    """
+
+    def __init__(
+        self,
+        timeout: float,
+        interval: float = 3,
+        backoff: float = 1,
+        max_interval: float | None = None,
+    ):
+        if timeout <= 0:
+            raise ValueError(f"Timeout must be positive, got {timeout}")
+        if interval <= 0:
+            raise ValueError(f"Interval must be positive, got {interval}")
+        if backoff < 1:
+            raise ValueError(f"Backoff must be at least 1, got {backoff}")
+        self.timeout = timeout
+        self.interval = interval
+        self.backoff = backoff
+        self.max_interval = max_interval
+
+    async def wait(self, check: Callable[[], Awaitable[bool]]) -> int:
+        """Call check until it returns True and return how many attempts that took"""
+        deadline = monotonic() + self.timeout
+        interval = self.interval
+        attempts = 0
+
+        while True:
+            attempts += 1
+            if await check():
+                return attempts
+            if monotonic() + interval > deadline:
+                raise PollTimeoutError(self.timeout, attempts)
+            await asyncio.sleep(interval)
+            interval *= self.backoff
+            if self.max_interval is not None:
+                interval = min(interval, self.max_interval)
@@ -0,0 +1,41 @@
+"""Request IDs tying together the API requests made for one operation"""
+from contextlib import contextmanager
+from contextvars import ContextVar
+from typing import Iterator
+import uuid
+
+_request_id: ContextVar[str] = ContextVar("thunder_request_id", default="")
+
+
+def current_request_id() -> str:
+    """ID of the operation in progress, or an empty string outside of one"""
+    return _request_id.get()
+
+
+def log_prefix() -> str:
+    """Prefix for log lines written during an operation, so they can be grepped by its ID"""
+    request_id = _request_id.get()
+    return f"[{request_id}] " if request_id else ""
+
+
+@contextmanager
+def use_request_id(request_id: str = "") -> Iterator[str]:
+    """Run an operation under a request ID and yield it
+
+    Every API request made inside carries the ID in its X-Request-ID header,
+    and it is included in logs and API errors. Without an explicit ID, an
+    operation nested in another keeps the outer one's and a new one is
+    generated otherwise, so Python code built on the module can wrap several
+    calls to have them share its own ID::
+
+        with use_request_id("nightly-1234"):
+            instance = await thunder.deploy_instance()
+            ...
+            await thunder.destroy(instance.instance_id)
+    """
+    request_id = request_id.strip() or _request_id.get() or str(uuid.uuid4())
+    reset = _request_id.set(request_id)
+    try:
+        yield request_id
+    finally:
+        _request_id.reset(reset)
@@ -0,0 +1,40 @@
+import json
+
+from thunder.errors import ThunderAPIError
+
+
+def test_json_error_body():
+    body = json.dumps({"error": "quota exceeded", "code": "QUOTA_EXCEEDED"})
+    error = ThunderAPIError.from_response("create Thunder instance", 429, body)
+    assert error.message == "quota exceeded"
+    assert error.code == "QUOTA_EXCEEDED"
+    assert error.status_code == 429
+    assert error.body == body
+    assert "HTTP 429, QUOTA_EXCEEDED" in str(error)
+
+
+def test_json_message_body():
+    error = ThunderAPIError.from_response("destroy Thunder instance", 404, '{"message": " not found "}')
+    assert error.message == "not found"
+    assert error.code == ""
+
+
+def test_nested_error_object():
+    body = json.dumps({"error": {"message": "invalid gpu type", "code": "INVALID_ARGUMENT"}})
+    error = ThunderAPIError.from_response("create Thunder instance", 400, body)
+    assert error.message == "invalid gpu type"
+    assert error.code == "INVALID_ARGUMENT"
+    assert "{" not in str(error)
+
+
+def test_plain_text_body():
+    error = ThunderAPIError.from_response("list Thunder instances", 502, "Bad Gateway\n")
+    assert error.message == "Bad Gateway"
+    assert error.code == ""
+    assert str(error).startswith("Failed to list Thunder instances (HTTP 502")
+
+
+def test_json_body_without_error_fields_is_used_verbatim():
+    error = ThunderAPIError.from_response("get Thunder instance", 500, '{"detail": "boom"}')
+    assert error.message == '{"detail": "boom"}'
+    assert error.code == ""
@@ -0,0 +1,39 @@
+import pytest
+
+from thunder.errors import InvalidBaseURLError
+from thunder.main import validate_base_url
+
+
+@pytest.mark.parametrize("url", ["", "   ", "\t\n"])
+def test_empty_url_is_rejected(url):
+    with pytest.raises(InvalidBaseURLError, match="URL is empty"):
+        validate_base_url(url)
+
+
+@pytest.mark.parametrize("url", ["https://", "http://", "https:///api"])
+def test_scheme_only_url_is_rejected(url):
+    with pytest.raises(InvalidBaseURLError, match="host is missing"):
+        validate_base_url(url)
+
+
+def test_bare_host_gets_scheme_and_api_path():
+    assert validate_base_url("  api.example.com/ ") == "https://api.example.com/api"
+
+
+@pytest.mark.parametrize("url", ["https:/dagger.jackdecker.org", "https:dagger.jackdecker.org", "http:/localhost"])
+def test_scheme_without_slashes_is_rejected(url):
+    with pytest.raises(InvalidBaseURLError, match="must be followed by //host"):
+        validate_base_url(url)
+
+
+def test_url_with_scheme_is_not_prefixed_again():
+    assert validate_base_url("https://dagger.jackdecker.org") == "https://dagger.jackdecker.org/api"
+
+
+@pytest.mark.parametrize("url, expected", [
+    ("dagger.jackdecker.org", "https://dagger.jackdecker.org/api"),
+    ("localhost:8080", "https://localhost:8080/api"),
+    ("http://localhost:8080/v2/", "http://localhost:8080/v2"),
+])
+def test_bare_hosts_and_paths(url, expected):
+    assert validate_base_url(url) == expected
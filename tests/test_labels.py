@@ -0,0 +1,34 @@
+from thunder.main import DeployOptions, Thunder
+
+
+def create_labels(thunder: Thunder, labels: dict[str, str]) -> dict[str, str]:
+    return thunder._create_body(DeployOptions(labels=labels)).get('labels', {})
+
+
+def test_label_precedence():
+    thunder = (
+        Thunder()
+        .with_default_labels(["team=ml", "ci-env=default", "ci-owner=default"])
+        # Sanitized into the ci-env and ci-owner labels
+        .with_context_labels_from_env(["CI_ENV=ci", "CI_OWNER=ci", "OTHER=ignored"], ["CI_"])
+    )
+
+    labels = create_labels(thunder, {"ci-owner": "call"})
+
+    assert labels["team"] == "ml"
+    assert labels["ci-env"] == "ci"
+    assert labels["ci-owner"] == "call"
+    assert "other" not in labels
+
+
+def test_default_labels_alone():
+    assert create_labels(Thunder().with_default_labels(["team=ml"]), {}) == {"team": "ml"}
+
+
+def test_no_labels_sends_none():
+    assert "labels" not in Thunder()._create_body(DeployOptions())
+
+
+def test_destroy_guard_label_wins():
+    thunder = Thunder().with_destroy_guard_label("team", "ml")
+    assert create_labels(thunder, {"team": "other"}) == {"team": "ml"}
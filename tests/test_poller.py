@@ -0,0 +1,89 @@
+import asyncio
+from unittest import mock
+
+import pytest
+
+from thunder.errors import PollTimeoutError
+from thunder.poller import Poller
+
+
+class Clock:
+    """Fake time for the poller: sleeping only advances the clock and records the delay"""
+
+    def __init__(self):
+        self.now = 0.0
+        self.sleeps = []
+
+    def monotonic(self):
+        return self.now
+
+    async def sleep(self, seconds):
+        self.sleeps.append(seconds)
+        self.now += seconds
+
+
+def wait(poller, results):
+    """Run poller.wait on a check returning results in turn, and return its outcome and the clock"""
+    clock = Clock()
+    calls = iter(results)
+
+    async def check():
+        return next(calls)
+
+    with mock.patch("thunder.poller.monotonic", clock.monotonic), mock.patch("thunder.poller.asyncio.sleep", clock.sleep):
+        return asyncio.run(poller.wait(check)), clock
+
+
+def test_stops_on_first_success():
+    attempts, clock = wait(Poller(timeout=60, interval=2), [False, False, True, False])
+    assert attempts == 3
+    assert clock.sleeps == [2, 2]
+
+
+def test_done_on_first_attempt_does_not_sleep():
+    attempts, clock = wait(Poller(timeout=60), [True])
+    assert attempts == 1
+    assert clock.sleeps == []
+
+
+def test_backoff_grows_interval_up_to_max_interval():
+    attempts, clock = wait(Poller(timeout=600, interval=1, backoff=2, max_interval=5), [False] * 5 + [True])
+    assert attempts == 6
+    assert clock.sleeps == [1, 2, 4, 5, 5]
+
+
+def test_times_out_before_sleeping_past_deadline():
+    clock = Clock()
+
+    async def check():
+        return False
+
+    with mock.patch("thunder.poller.monotonic", clock.monotonic), mock.patch("thunder.poller.asyncio.sleep", clock.sleep):
+        with pytest.raises(PollTimeoutError, match="after 4 attempts in 10s") as raised:
+            asyncio.run(Poller(timeout=10, interval=3).wait(check))
+    assert raised.value.attempts == 4
+    assert clock.sleeps == [3, 3, 3]
+    assert clock.now <= 10
+
+
+def test_check_errors_propagate_without_retry():
+    calls = []
+
+    async def check():
+        calls.append(1)
+        raise RuntimeError("boom")
+
+    with pytest.raises(RuntimeError, match="boom"):
+        asyncio.run(Poller(timeout=60, interval=0.01).wait(check))
+    assert len(calls) == 1
+
+
+@pytest.mark.parametrize("kwargs, message", [
+    ({"timeout": 0}, "Timeout must be positive"),
+    ({"timeout": -1}, "Timeout must be positive"),
+    ({"timeout": 10, "interval": 0}, "Interval must be positive"),
+    ({"timeout": 10, "backoff": 0.5}, "Backoff must be at least 1"),
+])
+def test_rejects_invalid_settings(kwargs, message):
+    with pytest.raises(ValueError, match=message):
+        Poller(**kwargs)
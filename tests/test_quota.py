@@ -0,0 +1,20 @@
+import pytest
+
+from thunder.models import parse_quota
+
+
+def test_quota_fields():
+    quota = parse_quota({"max_pods": 5, "used_pods": 2, "gpu_quota": 8})
+    assert (quota.max_pods, quota.used_pods, quota.gpu_quota) == (5, 2, 8)
+    assert quota.available_pods() == 3
+
+
+@pytest.mark.parametrize("field", ["max_pods", "used_pods", "gpu_quota"])
+def test_null_quota_field_counts_as_zero(field):
+    data = {"max_pods": 5, "used_pods": 2, "gpu_quota": 8, field: None}
+    assert getattr(parse_quota(data), field) == 0
+
+
+def test_missing_quota_fields_count_as_zero():
+    quota = parse_quota({})
+    assert (quota.max_pods, quota.used_pods, quota.gpu_quota) == (0, 0, 0)
@@ -0,0 +1,53 @@
+import asyncio
+import json
+
+import pytest
+
+from thunder.errors import InvalidResponseError
+from thunder.main import DeployOptions, Thunder
+from thunder.models import Instance, require_field
+
+CREATED = {"instance_id": "abc", "private_key": "KEY", "port": 22}
+
+
+@pytest.mark.parametrize("field", ["instance_id", "private_key", "port"])
+def test_create_response_missing_field(field):
+    response = {k: v for k, v in CREATED.items() if k != field}
+    with pytest.raises(InvalidResponseError, match=f"missing {field}"):
+        Thunder()._created_instance(response, json.dumps(response), DeployOptions())
+
+
+@pytest.mark.parametrize("value", [None, "", "   "])
+def test_require_field_rejects_empty_values(value):
+    with pytest.raises(InvalidResponseError, match="missing host"):
+        require_field({"host": value}, "host", "{}", "status")
+
+
+def test_require_field_trims_value():
+    assert require_field({"status": " running "}, "status", "{}", "status") == "running"
+
+
+def wait_until_running(pod):
+    thunder = Thunder()
+
+    async def api_request(token, method, path, **kwargs):
+        return 200, json.dumps(pod)
+
+    thunder._api_request = api_request
+    return asyncio.run(thunder._wait_until_running("token", Instance(instance_id="abc", port=22)))
+
+
+def test_status_response_missing_status():
+    with pytest.raises(InvalidResponseError, match="missing status"):
+        wait_until_running({"instance_id": "abc", "host": "1.2.3.4"})
+
+
+def test_status_response_missing_host():
+    with pytest.raises(InvalidResponseError, match="running instance has no host"):
+        wait_until_running({"instance_id": "abc", "status": "running"})
+
+
+def test_status_response_missing_instance_id_keeps_created_id():
+    running = wait_until_running({"status": "running", "host": "1.2.3.4"})
+    assert running.instance_id == "abc"
+    assert running.host == "1.2.3.4"
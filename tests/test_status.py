@@ -0,0 +1,18 @@
+import pytest
+
+from thunder.models import normalize_status, parse_instance
+
+
+@pytest.mark.parametrize("value", ["RUNNING", "Running", "  running  ", "\tRuNnInG\n"])
+def test_normalize_status_ignores_case_and_padding(value):
+    assert normalize_status(value) == "running"
+
+
+def test_normalize_status_handles_missing_value():
+    assert normalize_status(None) == ""
+
+
+@pytest.mark.parametrize("value", [" STOPPED ", "Stopped", "stopped\n"])
+def test_parse_instance_normalizes_status(value):
+    instance = parse_instance({"instance_id": "abc", "status": value, "host": "1.2.3.4"})
+    assert instance.status == "stopped"
@@ -0,0 +1,45 @@
+from contextlib import contextmanager
+
+import pytest
+
+from thunder.errors import InvalidResponseError
+from thunder.models import parse_instance, parse_quota, set_strict_decoding
+
+POD = {"instance_id": "abc", "status": "running", "host": "1.2.3.4"}
+QUOTA = {"max_pods": 5, "used_pods": 2, "gpu_quota": 8}
+
+
+@contextmanager
+def strict_decoding(enabled):
+    set_strict_decoding(enabled)
+    try:
+        yield
+    finally:
+        set_strict_decoding(False)
+
+
+def test_strict_decoding_rejects_unknown_instance_field():
+    with strict_decoding(True), pytest.raises(InvalidResponseError, match="unknown fields surprise"):
+        parse_instance({**POD, "surprise": 1})
+
+
+def test_strict_decoding_rejects_unknown_volume_field():
+    with strict_decoding(True), pytest.raises(InvalidResponseError, match="unknown fields surprise"):
+        parse_instance({**POD, "volumes": [{"id": "data", "mount_path": "/data", "surprise": 1}]})
+
+
+def test_strict_decoding_rejects_unknown_quota_field():
+    with strict_decoding(True), pytest.raises(InvalidResponseError, match="unknown fields surprise"):
+        parse_quota({**QUOTA, "surprise": 1})
+
+
+def test_strict_decoding_accepts_known_fields():
+    with strict_decoding(True):
+        assert parse_instance(POD).instance_id == "abc"
+        assert parse_quota(QUOTA).max_pods == 5
+
+
+def test_lenient_decoding_ignores_unknown_fields():
+    with strict_decoding(False):
+        assert parse_instance({**POD, "surprise": 1}).instance_id == "abc"
+        assert parse_quota({**QUOTA, "surprise": 1}).max_pods == 5
@@ -0,0 +1,40 @@
+from datetime import datetime, timedelta, timezone
+
+import pytest
+
+from thunder.models import Instance, parse_timestamp
+
+
+@pytest.mark.parametrize("value", [
+    "2024-05-01T12:30:00Z",
+    "2024-05-01T12:30:00+00:00",
+    "2024-05-01T14:30:00+02:00",
+    "2024-05-01T12:30:00",
+])
+def test_rfc3339(value):
+    assert parse_timestamp(value) == datetime(2024, 5, 1, 12, 30, tzinfo=timezone.utc)
+
+
+@pytest.mark.parametrize("value", ["1714566600", "1714566600.0"])
+def test_unix_seconds(value):
+    assert parse_timestamp(value) == datetime(2024, 5, 1, 12, 30, tzinfo=timezone.utc)
+
+
+@pytest.mark.parametrize("value", ["", "yesterday", "2024-13-01T00:00:00Z"])
+def test_unparseable_timestamps(value):
+    assert parse_timestamp(value) is None
+
+
+def test_age_of_past_instance():
+    created = datetime.now(timezone.utc) - timedelta(hours=1)
+    age = Instance(created_at=created.isoformat()).age_seconds()
+    assert 3590 < age < 3700
+
+
+def test_future_created_at_counts_as_zero_age():
+    created = datetime.now(timezone.utc) + timedelta(minutes=5)
+    assert Instance(created_at=str(int(created.timestamp()))).age_seconds() == 0.0
+
+
+def test_unknown_created_at_counts_as_zero_age():
+    assert Instance(created_at="").age_seconds() == 0.0